@@ -1,7 +1,12 @@
 package backends
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -12,14 +17,61 @@ import (
 
 // Backend represents a command to execute when another application changes
 type Backend struct {
-	Name             string      `mapstructure:"name"`
-	Poll             int         `mapstructure:"poll"` // time in seconds
-	OnChangeExec     interface{} `mapstructure:"onChange"`
-	Tag              string      `mapstructure:"tag"`
-	Timeout          string      `mapstructure:"timeout"`
+	Name             string            `mapstructure:"name"`
+	Poll             int               `mapstructure:"poll"` // time in seconds
+	OnChangeExec     interface{}       `mapstructure:"onChange"`
+	Tag              string            `mapstructure:"tag"`
+	Tags             []string          `mapstructure:"tags"`
+	Datacenter       string            `mapstructure:"datacenter"`
+	NodeMeta         map[string]string `mapstructure:"nodeMeta"`
+	Near             string            `mapstructure:"near"`
+	Timeout          string            `mapstructure:"timeout"`
+	Watch            bool              `mapstructure:"watch"`
+	MaxWait          string            `mapstructure:"maxWait"`
+	Debounce         string            `mapstructure:"debounce"`
+	DebounceMaxWait  string            `mapstructure:"debounceMaxWait"`
+	Required         bool              `mapstructure:"required"`
+	MinInstances     int               `mapstructure:"minInstances"`
+	RequiredTimeout  string            `mapstructure:"requiredTimeout"`
+	OnTimeout        string            `mapstructure:"onRequiredTimeout"`
+	ChangeOn         []string          `mapstructure:"changeOn"`
+	maxWait          time.Duration
+	debounce         time.Duration
+	debounceMaxWait  time.Duration
+	requiredTimeout  time.Duration
 	discoveryService discovery.ServiceBackend
 	lastState        interface{}
 	onChangeCmd      *commands.Command
+
+	// upstream is the state of the backend in the discovery service. Of
+	// its instances, instances are those that `changeOn` considers, and
+	// notified are those last passed to the onChange command.
+	upstream  *discovery.Upstream
+	instances []discovery.ServiceInstance
+	notified  []discovery.ServiceInstance
+	listed    bool
+
+	// debounce and onChange state, guarded by changeLock. Once stopped,
+	// changes no longer fire the onChange command.
+	changeLock  sync.Mutex
+	stopped     bool
+	changeTimer *time.Timer
+	changeGen   int
+	firstChange time.Time
+	running     bool
+	rerun       bool
+}
+
+// Upstreams is the JSON document passed to the onChange command on its
+// stdin, and in the file named by the CONTAINERPILOT_UPSTREAMS_FILE
+// environment variable. Added and removed are relative to the instances
+// last passed to the command, or to the first check of the backend.
+type Upstreams struct {
+	Backend   string                      `json:"backend"`
+	Tag       string                      `json:"tag,omitempty"`
+	Instances []discovery.ServiceInstance `json:"instances"`
+	Added     []discovery.ServiceInstance `json:"added"`
+	Removed   []discovery.ServiceInstance `json:"removed"`
 }
 
 // NewBackends creates a new backend from a raw config structure
@@ -31,7 +83,6 @@ func NewBackends(raw []interface{}, disc discovery.ServiceBackend) ([]*Backend,
 	if err := utils.DecodeRaw(raw, &backends); err != nil {
 		return nil, fmt.Errorf("Backend configuration error: %v", err)
 	}
-	log.Printf("\nafter decode backends are: %v\n", *backends[0])
 	for _, b := range backends {
 		if err := utils.ValidateServiceName(b.Name); err != nil {
 			return nil, err
@@ -52,15 +103,190 @@ func NewBackends(raw []interface{}, disc discovery.ServiceBackend) ([]*Backend,
 			return nil, fmt.Errorf("`poll` must be > 0 in backend %s",
 				b.Name)
 		}
-		b.onChangeCmd = cmd
 		b.discoveryService = disc
+		b.upstream = discovery.NewUpstream(b.Name, b.Tag)
+
+		if err := parseWatch(b); err != nil {
+			return nil, err
+		}
+		if err := parseDebounce(b); err != nil {
+			return nil, err
+		}
+		if err := parseRequired(b); err != nil {
+			return nil, err
+		}
+		if err := parseChangeOn(b); err != nil {
+			return nil, err
+		}
+		if err := parseFilters(b); err != nil {
+			return nil, err
+		}
 	}
 	return backends, nil
 }
 
+// the default maximum time a watch will block waiting for a change
+const defaultMaxWait = "60s"
+
+func parseWatch(b *Backend) error {
+	if !b.Watch {
+		return nil
+	}
+	if b.discoveryService != nil {
+		if _, ok := b.discoveryService.(discovery.UpstreamWatcher); !ok {
+			return fmt.Errorf("`watch` is not supported by the discovery service in backend %s",
+				b.Name)
+		}
+	}
+	if b.MaxWait == "" {
+		b.MaxWait = defaultMaxWait
+	}
+	maxWait, err := utils.ParseDuration(b.MaxWait)
+	if err != nil {
+		return fmt.Errorf("Could not parse `maxWait` in backend %s: %s",
+			b.Name, err)
+	}
+	if maxWait < time.Second {
+		return fmt.Errorf("`maxWait` must be >= 1s in backend %s", b.Name)
+	}
+	b.maxWait = maxWait
+	return nil
+}
+
+func parseDebounce(b *Backend) error {
+	if b.Debounce != "" {
+		debounce, err := utils.ParseDuration(b.Debounce)
+		if err != nil {
+			return fmt.Errorf("Could not parse `debounce` in backend %s: %s",
+				b.Name, err)
+		}
+		b.debounce = debounce
+	}
+	if b.DebounceMaxWait != "" {
+		if b.debounce == 0 {
+			return fmt.Errorf("`debounceMaxWait` requires `debounce` in backend %s",
+				b.Name)
+		}
+		maxWait, err := utils.ParseDuration(b.DebounceMaxWait)
+		if err != nil {
+			return fmt.Errorf("Could not parse `debounceMaxWait` in backend %s: %s",
+				b.Name, err)
+		}
+		if maxWait < b.debounce {
+			return fmt.Errorf("`debounceMaxWait` must be >= `debounce` in backend %s",
+				b.Name)
+		}
+		b.debounceMaxWait = maxWait
+	}
+	return nil
+}
+
+// What to do when a required backend doesn't have enough instances
+// within its `requiredTimeout`
+const (
+	OnTimeoutExit     = "exit"
+	OnTimeoutContinue = "continue"
+)
+
+func parseRequired(b *Backend) error {
+	if !b.Required {
+		if b.MinInstances != 0 || b.RequiredTimeout != "" || b.OnTimeout != "" {
+			return fmt.Errorf("`minInstances`, `requiredTimeout` and `onRequiredTimeout` require `required` in backend %s",
+				b.Name)
+		}
+		return nil
+	}
+	if b.MinInstances == 0 {
+		b.MinInstances = 1
+	}
+	if b.MinInstances < 0 {
+		return fmt.Errorf("`minInstances` must be > 0 in backend %s", b.Name)
+	}
+	if b.RequiredTimeout != "" {
+		timeout, err := utils.ParseDuration(b.RequiredTimeout)
+		if err != nil {
+			return fmt.Errorf("Could not parse `requiredTimeout` in backend %s: %s",
+				b.Name, err)
+		}
+		b.requiredTimeout = timeout
+	}
+	switch b.OnTimeout {
+	case "":
+		b.OnTimeout = OnTimeoutExit
+	case OnTimeoutExit, OnTimeoutContinue:
+	default:
+		return fmt.Errorf("`onRequiredTimeout` must be one of `exit` or `continue` in backend %s",
+			b.Name)
+	}
+	return nil
+}
+
+func parseChangeOn(b *Backend) error {
+	if len(b.ChangeOn) == 0 {
+		b.ChangeOn = []string{discovery.ChangeOnAddress}
+		return nil
+	}
+	for _, on := range b.ChangeOn {
+		switch on {
+		case discovery.ChangeOnAddress, discovery.ChangeOnTags,
+			discovery.ChangeOnMeta, discovery.ChangeOnStatus:
+		default:
+			return fmt.Errorf("`changeOn` must be one of `address`, `tags`, `meta` or `status` in backend %s",
+				b.Name)
+		}
+	}
+	return nil
+}
+
+// parseFilters adds the `tags`, `datacenter`, `nodeMeta` and `near`
+// options to the backend's upstream. Only the tags are supported by every
+// discovery service.
+func parseFilters(b *Backend) error {
+	for _, tag := range b.Tags {
+		if !contains(b.upstream.Tags, tag) {
+			b.upstream.Tags = append(b.upstream.Tags, tag)
+		}
+	}
+	var used []string
+	if b.Datacenter != "" {
+		used = append(used, "datacenter")
+	}
+	if len(b.NodeMeta) > 0 {
+		used = append(used, "nodeMeta")
+	}
+	if b.Near != "" {
+		used = append(used, "near")
+	}
+	if len(used) > 0 && b.discoveryService != nil {
+		var supported []string
+		if filter, ok := b.discoveryService.(discovery.NodeFilter); ok {
+			supported = filter.NodeFilters()
+		}
+		for _, option := range used {
+			if !contains(supported, option) {
+				return fmt.Errorf("`%s` is not supported by the discovery service in backend %s",
+					option, b.Name)
+			}
+		}
+	}
+	b.upstream.Datacenter = b.Datacenter
+	b.upstream.NodeMeta = b.NodeMeta
+	b.upstream.Near = b.Near
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // PollTime implements Pollable for Backend
 // It returns the backend's poll interval.
-func (b Backend) PollTime() time.Duration {
+func (b *Backend) PollTime() time.Duration {
 	return time.Duration(b.Poll) * time.Second
 }
 
@@ -69,23 +295,302 @@ func (b Backend) PollTime() time.Duration {
 // we fire the on change handler.
 func (b *Backend) PollAction() {
 	if b.CheckForUpstreamChanges() {
-		b.OnChange()
+		b.Changed()
 	}
 }
 
-// PollStop does nothing in a Backend
+// Watching implements Watchable for Backend. It returns true if the
+// backend should use blocking watches rather than fixed polling.
+func (b *Backend) Watching() bool {
+	return b.Watch
+}
+
+// WatchAction implements Watchable for Backend. It blocks until the
+// discovery service reports a change or `maxWait` elapses, and fires the
+// on change handler if there was a change. If the watch fails we wait
+// out the poll interval and fall back to a regular poll.
+func (b *Backend) WatchAction() {
+	watcher := b.discoveryService.(discovery.UpstreamWatcher)
+	didChange, err := watcher.WatchForUpstreamChanges(b.upstream, b.maxWait)
+	if b.isStopped() {
+		return // the watch was for a config that's since been reloaded
+	}
+	if err != nil {
+		log.Warnf("Failed to watch backend %s, falling back to polling: %v",
+			b.Name, err)
+		time.Sleep(b.PollTime())
+		b.PollAction()
+		return
+	}
+	if b.updateInstances() || didChange {
+		b.Changed()
+	}
+}
+
+// PollStop cancels any onChange waiting out its debounce period, and
+// closes the upstream to release the backend's state in the discovery
+// service. The discovery services that can watch for changes cancel
+// their watch when the upstream is closed. Changes seen after it's
+// stopped are ignored.
 func (b *Backend) PollStop() {
-	// Nothing to do
+	b.StopChanges()
+	b.upstream.Close()
+}
+
+// StopChanges makes the backend ignore any further changes and cancels
+// an onChange waiting out its debounce period. It returns true if one
+// was pending, so that on reload the backend that replaces this one can
+// fire it instead.
+func (b *Backend) StopChanges() bool {
+	b.changeLock.Lock()
+	defer b.changeLock.Unlock()
+	pending := b.changeTimer != nil
+	b.stopped = true
+	b.cancelDebounce()
+	return pending
+}
+
+func (b *Backend) isStopped() bool {
+	b.changeLock.Lock()
+	defer b.changeLock.Unlock()
+	return b.stopped
+}
+
+// Changed is called when the backend has changed. Without a `debounce`
+// the onChange command runs right away; otherwise it runs once the
+// backend has gone `debounce` without changing, or `debounceMaxWait`
+// after the first of the changes, whichever comes first.
+func (b *Backend) Changed() {
+	b.changeLock.Lock()
+	if b.stopped {
+		b.changeLock.Unlock()
+		return
+	}
+	if b.debounce == 0 {
+		b.changeLock.Unlock()
+		b.runOnChange()
+		return
+	}
+	defer b.changeLock.Unlock()
+	now := time.Now()
+	if b.changeTimer == nil {
+		b.firstChange = now
+	}
+	wait := b.debounce
+	if b.debounceMaxWait > 0 {
+		if remaining := b.firstChange.Add(b.debounceMaxWait).Sub(now); remaining < wait {
+			wait = remaining
+		}
+	}
+	b.cancelDebounce()
+	gen := b.changeGen
+	b.changeTimer = time.AfterFunc(wait, func() {
+		b.changeLock.Lock()
+		if gen != b.changeGen {
+			// the timer was replaced or cancelled as it fired
+			b.changeLock.Unlock()
+			return
+		}
+		b.changeTimer = nil
+		b.changeLock.Unlock()
+		b.runOnChange()
+	})
+}
+
+// cancelDebounce stops the debounce timer; it must be called with the
+// changeLock held
+func (b *Backend) cancelDebounce() {
+	b.changeGen++
+	if b.changeTimer != nil {
+		b.changeTimer.Stop()
+		b.changeTimer = nil
+	}
+}
+
+// runOnChange runs the onChange command, unless it's already running for
+// this backend. In that case the running command is run once more after
+// it exits, so that changes made while it ran are never missed but only
+// one onChange runs at a time.
+func (b *Backend) runOnChange() {
+	b.changeLock.Lock()
+	if b.running {
+		b.rerun = true
+		b.changeLock.Unlock()
+		return
+	}
+	b.running = true
+	b.changeLock.Unlock()
+	for {
+		b.OnChange()
+		b.changeLock.Lock()
+		if !b.rerun {
+			b.running = false
+			b.changeLock.Unlock()
+			return
+		}
+		b.rerun = false
+		b.changeLock.Unlock()
+	}
 }
 
 // CheckForUpstreamChanges checks the service discovery endpoint for any changes
 // in a dependent backend. Returns true when there has been a change.
 func (b *Backend) CheckForUpstreamChanges() bool {
-	return b.discoveryService.CheckForUpstreamChanges(b.Name, b.Tag)
+	didChange := b.discoveryService.CheckForUpstreamChanges(b.upstream)
+	return b.updateInstances() || didChange
 }
 
-// OnChange runs the backend's onChange command, returning the results
+// WaitForInstances blocks until the backend has at least `minInstances`
+// healthy instances, checking every `poll` seconds. It returns an error
+// if `requiredTimeout` elapses first, or if stop is closed. Changes seen
+// while waiting fire the onChange handler as usual.
+func (b *Backend) WaitForInstances(stop <-chan struct{}) error {
+	var timeout <-chan time.Time
+	if b.requiredTimeout > 0 {
+		timer := time.NewTimer(b.requiredTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		if b.CheckForUpstreamChanges() {
+			b.Changed()
+		}
+		b.changeLock.Lock()
+		count := len(discovery.PassingInstances(b.instances))
+		b.changeLock.Unlock()
+		if count >= b.MinInstances {
+			return nil
+		}
+		log.Infof("Waiting for backend %s: %d of %d required instances",
+			b.Name, count, b.MinInstances)
+		select {
+		case <-time.After(b.PollTime()):
+		case <-timeout:
+			return fmt.Errorf("Timed out waiting for backend %s: %d of %d required instances",
+				b.Name, count, b.MinInstances)
+		case <-stop:
+			return fmt.Errorf("Stopped waiting for backend %s", b.Name)
+		}
+	}
+}
+
+// updateInstances records the instances seen by the last check. Instances
+// with a warning status are only kept if `changeOn` includes the status.
+// It returns true if any of the `changeOn` fields of the instances
+// changed since the last check.
+func (b *Backend) updateInstances() bool {
+	if !b.upstream.Seen() {
+		return false // the discovery service couldn't be queried
+	}
+	instances := b.upstream.Instances()
+	if !b.changesOn(discovery.ChangeOnStatus) {
+		instances = discovery.PassingInstances(instances)
+	}
+	b.changeLock.Lock()
+	defer b.changeLock.Unlock()
+	didChange := b.listed &&
+		discovery.CompareForChange(b.instances, instances, b.ChangeOn)
+	b.instances = instances
+	if !b.listed {
+		// the onChange command is first told about changes from the
+		// instances we started with
+		b.notified = instances
+		b.listed = true
+	}
+	return didChange
+}
+
+func (b *Backend) changesOn(field string) bool {
+	return contains(b.ChangeOn, field)
+}
+
+// OnChange runs the backend's onChange command, returning the results.
+// The instances of the backend are passed to the command as described in
+// Upstreams, and as a comma separated list of address:port in
+// CONTAINERPILOT_<BACKEND>_ADDRS.
 func (b *Backend) OnChange() error {
+	b.onChangeCmd.Env = nil
+	b.onChangeCmd.Stdin = nil
+	if b.upstream != nil {
+		upstreamsFile, err := b.setUpstreams()
+		if err != nil {
+			log.Warnf("Could not pass upstreams to onChange in backend %s: %v",
+				b.Name, err)
+		} else {
+			defer os.Remove(upstreamsFile)
+		}
+	}
 	return commands.RunWithTimeout(b.onChangeCmd, log.Fields{
 		"process": "onChange", "backend": b.Name})
 }
+
+// setUpstreams sets the environment and stdin of the onChange command,
+// returning the path of the file it wrote the upstreams to
+func (b *Backend) setUpstreams() (string, error) {
+	b.changeLock.Lock()
+	instances, notified := b.instances, b.notified
+	b.notified = instances
+	b.changeLock.Unlock()
+	upstreams := Upstreams{
+		Backend:   b.Name,
+		Tag:       b.Tag,
+		Instances: instances,
+		Added:     diffInstances(instances, notified),
+		Removed:   diffInstances(notified, instances),
+	}
+	if upstreams.Instances == nil {
+		upstreams.Instances = []discovery.ServiceInstance{}
+	}
+	buf, err := json.Marshal(upstreams)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "containerpilot-upstreams")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	addrs := make([]string, len(instances))
+	for i, instance := range instances {
+		addrs[i] = fmt.Sprintf("%s:%d", instance.Address, instance.Port)
+	}
+	b.onChangeCmd.Env = []string{
+		fmt.Sprintf("CONTAINERPILOT_%s_ADDRS=%s", getEnvVarName(b.Name),
+			strings.Join(addrs, ",")),
+		fmt.Sprintf("CONTAINERPILOT_UPSTREAMS_FILE=%s", f.Name()),
+	}
+	b.onChangeCmd.Stdin = buf
+	return f.Name(), nil
+}
+
+// diffInstances returns the instances that aren't in other, comparing
+// their ID, address and port
+func diffInstances(instances, other []discovery.ServiceInstance) []discovery.ServiceInstance {
+	diff := []discovery.ServiceInstance{}
+	for _, instance := range instances {
+		found := false
+		for _, o := range other {
+			if o.ID == instance.ID && o.Address == instance.Address &&
+				o.Port == instance.Port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, instance)
+		}
+	}
+	return diff
+}
+
+// getEnvVarName returns the backend name in the form used in the names
+// of environment variables
+func getEnvVarName(name string) string {
+	name = strings.ToUpper(name)
+	name = strings.Replace(name, "-", "_", -1)
+	return name
+}
@@ -2,10 +2,18 @@ package backends
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/memory"
 )
 
 func TestOnChangeCmd(t *testing.T) {
@@ -22,6 +30,110 @@ func TestOnChangeCmd(t *testing.T) {
 	}
 }
 
+func TestOnChangeUpstreams(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "containerpilot")
+	defer os.RemoveAll(dir)
+	disc := memory.NewMemory()
+	cmd, _ := commands.NewCommand([]interface{}{"sh", "-c",
+		"cat > $0/stdin; cat $CONTAINERPILOT_UPSTREAMS_FILE > $0/file; " +
+			"echo -n $CONTAINERPILOT_MY_APP_ADDRS > $0/addrs", dir}, "1s")
+	backend := &Backend{Name: "my-app", onChangeCmd: cmd, discoveryService: disc,
+		upstream: discovery.NewUpstream("my-app", "")}
+
+	instanceA := &discovery.ServiceDefinition{ID: "a", Name: "my-app",
+		IPAddress: "192.168.1.1", Port: 80}
+	instanceB := &discovery.ServiceDefinition{ID: "b", Name: "my-app",
+		IPAddress: "192.168.1.2", Port: 80}
+	disc.SetUpstreams("my-app", instanceA)
+	backend.CheckForUpstreamChanges()
+	disc.SetUpstreams("my-app", instanceB)
+	if !backend.CheckForUpstreamChanges() {
+		t.Fatalf("Expected change after replacing upstream")
+	}
+	if err := backend.OnChange(); err != nil {
+		t.Fatalf("Unexpected error OnChange: %s", err)
+	}
+
+	a := discovery.ServiceInstance{ID: "a", Address: "192.168.1.1", Port: 80,
+		Status: discovery.StatusPassing}
+	b := discovery.ServiceInstance{ID: "b", Address: "192.168.1.2", Port: 80,
+		Status: discovery.StatusPassing}
+	expected := Upstreams{
+		Backend:   "my-app",
+		Instances: []discovery.ServiceInstance{b},
+		Added:     []discovery.ServiceInstance{b},
+		Removed:   []discovery.ServiceInstance{a},
+	}
+	for _, name := range []string{"stdin", "file"} {
+		buf, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		var upstreams Upstreams
+		if err := json.Unmarshal(buf, &upstreams); err != nil {
+			t.Fatalf("Could not decode upstreams from %s: %v (%q)", name, err, buf)
+		}
+		if !reflect.DeepEqual(expected, upstreams) {
+			t.Errorf("Expected upstreams %+v from %s but got %+v", expected, name, upstreams)
+		}
+	}
+	if addrs, _ := ioutil.ReadFile(filepath.Join(dir, "addrs")); strings.TrimSpace(string(addrs)) != "192.168.1.2:80" {
+		t.Errorf("Expected CONTAINERPILOT_MY_APP_ADDRS=192.168.1.2:80 but got %q", addrs)
+	}
+}
+
+func TestOnChangeDebounce(t *testing.T) {
+	backend, count := newCountingBackend(t, "")
+	defer os.RemoveAll(filepath.Dir(count))
+	backend.debounce = 100 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		backend.Changed()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if runs := countRuns(count); runs != 0 {
+		t.Fatalf("Expected no onChange during debounce but got %d", runs)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if runs := countRuns(count); runs != 1 {
+		t.Errorf("Expected changes to be coalesced into 1 onChange but got %d", runs)
+	}
+}
+
+func TestOnChangeDebounceMaxWait(t *testing.T) {
+	backend, count := newCountingBackend(t, "")
+	defer os.RemoveAll(filepath.Dir(count))
+	backend.debounce = 200 * time.Millisecond
+	backend.debounceMaxWait = 300 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		backend.Changed()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if runs := countRuns(count); runs != 1 {
+		t.Errorf("Expected 1 onChange after maxWait but got %d", runs)
+	}
+	backend.PollStop()
+	time.Sleep(300 * time.Millisecond)
+	if runs := countRuns(count); runs != 1 {
+		t.Errorf("Expected pending onChange to be cancelled but got %d", runs)
+	}
+}
+
+func TestOnChangeSingleFlight(t *testing.T) {
+	backend, count := newCountingBackend(t, "sleep 0.2; ")
+	defer os.RemoveAll(filepath.Dir(count))
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backend.Changed()
+		}()
+	}
+	wg.Wait()
+	// the first change runs onChange and the others coalesce into a
+	// single re-run once it's done
+	if runs := countRuns(count); runs != 2 {
+		t.Errorf("Expected 2 onChange runs but got %d", runs)
+	}
+}
+
 type TestFragmentBackends struct {
 	Backends []Backend
 }
@@ -60,6 +172,11 @@ func TestBackendsParse(t *testing.T) {
 
 func TestBackendsConfigError(t *testing.T) {
 	var raw []interface{}
+	// an empty list of backends is valid
+	if backends, err := NewBackends([]interface{}{}, nil); err != nil || len(backends) != 0 {
+		t.Errorf("Expected no backends and no error but got %v (%v)", backends, err)
+	}
+
 	json.Unmarshal([]byte(`[{"name": ""}]`), &raw)
 	_, err := NewBackends(raw, nil)
 	validateBackendConfigError(t, err, "`name` must not be blank")
@@ -79,9 +196,288 @@ func TestBackendsConfigError(t *testing.T) {
 	validateBackendConfigError(t, err, "`poll` must be > 0 in backend myName")
 }
 
+func TestBackendsWatchParse(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[
+{"name": "upstreamA", "poll": 11, "onChange": "/bin/true", "watch": true},
+{"name": "upstreamB", "poll": 11, "onChange": "/bin/true", "watch": true, "maxWait": "5m"},
+{"name": "upstreamC", "poll": 11, "onChange": "/bin/true", "maxWait": "5m"}
+]`), &raw)
+	backends, err := NewBackends(raw, nil)
+	if err != nil {
+		t.Fatalf("Could not parse backends JSON: %s", err)
+	}
+	if !backends[0].Watching() || backends[0].maxWait != 60*time.Second {
+		t.Errorf("Expected watch with default maxWait but got %v", backends[0].maxWait)
+	}
+	if !backends[1].Watching() || backends[1].maxWait != 5*time.Minute {
+		t.Errorf("Expected watch with maxWait=5m but got %v", backends[1].maxWait)
+	}
+	if backends[2].Watching() || backends[2].maxWait != 0 {
+		t.Errorf("Expected no watch but got maxWait=%v", backends[2].maxWait)
+	}
+}
+
+func TestBackendsDebounceParse(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[
+{"name": "upstreamA", "poll": 11, "onChange": "/bin/true", "debounce": "5s"},
+{"name": "upstreamB", "poll": 11, "onChange": "/bin/true", "debounce": "5s", "debounceMaxWait": "30s"},
+{"name": "upstreamC", "poll": 11, "onChange": "/bin/true"}
+]`), &raw)
+	backends, err := NewBackends(raw, nil)
+	if err != nil {
+		t.Fatalf("Could not parse backends JSON: %s", err)
+	}
+	if backends[0].debounce != 5*time.Second || backends[0].debounceMaxWait != 0 {
+		t.Errorf("Expected debounce=5s but got %v/%v",
+			backends[0].debounce, backends[0].debounceMaxWait)
+	}
+	if backends[1].debounce != 5*time.Second || backends[1].debounceMaxWait != 30*time.Second {
+		t.Errorf("Expected debounce=5s, debounceMaxWait=30s but got %v/%v",
+			backends[1].debounce, backends[1].debounceMaxWait)
+	}
+	if backends[2].debounce != 0 {
+		t.Errorf("Expected no debounce but got %v", backends[2].debounce)
+	}
+}
+
+func TestBackendsDebounceConfigError(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "debounce": "xx"}]`), &raw)
+	_, err := NewBackends(raw, nil)
+	validateBackendConfigError(t, err,
+		"Could not parse `debounce` in backend myName: time: invalid duration xx")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "debounceMaxWait": "10s"}]`), &raw)
+	_, err = NewBackends(raw, nil)
+	validateBackendConfigError(t, err, "`debounceMaxWait` requires `debounce` in backend myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "debounce": "10s", "debounceMaxWait": "5s"}]`), &raw)
+	_, err = NewBackends(raw, nil)
+	validateBackendConfigError(t, err, "`debounceMaxWait` must be >= `debounce` in backend myName")
+}
+
+func TestBackendsRequiredParse(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[
+{"name": "upstreamA", "poll": 11, "onChange": "/bin/true", "required": true},
+{"name": "upstreamB", "poll": 11, "onChange": "/bin/true", "required": true,
+ "minInstances": 3, "requiredTimeout": "2m", "onRequiredTimeout": "continue"}
+]`), &raw)
+	backends, err := NewBackends(raw, memory.NewMemory())
+	if err != nil {
+		t.Fatalf("Could not parse backends JSON: %s", err)
+	}
+	if b := backends[0]; b.MinInstances != 1 || b.requiredTimeout != 0 || b.OnTimeout != OnTimeoutExit {
+		t.Errorf("Expected default required options but got %d/%v/%s",
+			b.MinInstances, b.requiredTimeout, b.OnTimeout)
+	}
+	if b := backends[1]; b.MinInstances != 3 || b.requiredTimeout != 2*time.Minute || b.OnTimeout != OnTimeoutContinue {
+		t.Errorf("Expected minInstances=3, requiredTimeout=2m, onRequiredTimeout=continue but got %d/%v/%s",
+			b.MinInstances, b.requiredTimeout, b.OnTimeout)
+	}
+}
+
+func TestBackendsRequiredConfigError(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "minInstances": 2}]`), &raw)
+	_, err := NewBackends(raw, nil)
+	validateBackendConfigError(t, err,
+		"`minInstances`, `requiredTimeout` and `onRequiredTimeout` require `required` in backend myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "required": true, "minInstances": -1}]`), &raw)
+	_, err = NewBackends(raw, nil)
+	validateBackendConfigError(t, err, "`minInstances` must be > 0 in backend myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "required": true, "onRequiredTimeout": "panic"}]`), &raw)
+	_, err = NewBackends(raw, nil)
+	validateBackendConfigError(t, err,
+		"`onRequiredTimeout` must be one of `exit` or `continue` in backend myName")
+}
+
+func TestWaitForInstances(t *testing.T) {
+	disc := memory.NewMemory()
+	cmd, _ := commands.NewCommand("/bin/true", "1s")
+	backend := &Backend{Name: "db", Poll: 1, onChangeCmd: cmd,
+		discoveryService: disc, upstream: discovery.NewUpstream("db", ""),
+		Required: true, MinInstances: 2,
+		requiredTimeout: 100 * time.Millisecond}
+	disc.SetUpstreams("db", &discovery.ServiceDefinition{
+		ID: "db-1", Name: "db", IPAddress: "192.168.1.1", Port: 5432})
+	if err := backend.WaitForInstances(nil); err == nil ||
+		err.Error() != "Timed out waiting for backend db: 1 of 2 required instances" {
+		t.Errorf("Expected timeout error but got %v", err)
+	}
+
+	backend.requiredTimeout = 0
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		disc.SetUpstreams("db",
+			&discovery.ServiceDefinition{ID: "db-1", Name: "db", IPAddress: "192.168.1.1", Port: 5432},
+			&discovery.ServiceDefinition{ID: "db-2", Name: "db", IPAddress: "192.168.1.2", Port: 5432})
+	}()
+	if err := backend.WaitForInstances(nil); err != nil {
+		t.Errorf("Unexpected error waiting for instances: %v", err)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	backend.MinInstances = 3
+	if err := backend.WaitForInstances(stop); err == nil {
+		t.Errorf("Expected error after stop but got nil")
+	}
+}
+
+func TestBackendsChangeOnConfigError(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "changeOn": ["tags", "color"]}]`), &raw)
+	_, err := NewBackends(raw, nil)
+	validateBackendConfigError(t, err,
+		"`changeOn` must be one of `address`, `tags`, `meta` or `status` in backend myName")
+}
+
+func TestChangeOn(t *testing.T) {
+	disc := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[
+{"name": "app", "poll": 1, "onChange": "/bin/true"},
+{"name": "app", "poll": 1, "onChange": "/bin/true", "changeOn": ["tags"]},
+{"name": "app", "poll": 1, "onChange": "/bin/true", "changeOn": ["status"]}
+]`), &raw)
+	backends, err := NewBackends(raw, disc)
+	if err != nil {
+		t.Fatalf("Could not parse backends JSON: %s", err)
+	}
+	addr, tags, status := backends[0], backends[1], backends[2]
+	check := func(step string, expected ...bool) {
+		for i, b := range []*Backend{addr, tags, status} {
+			if changed := b.CheckForUpstreamChanges(); changed != expected[i] {
+				t.Errorf("%s: expected change=%v for changeOn %v but got %v",
+					step, expected[i], b.ChangeOn, changed)
+			}
+		}
+	}
+	service := &discovery.ServiceDefinition{ID: "app-1", Name: "app",
+		IPAddress: "192.168.1.1", Port: 80, Tags: []string{"v1"}}
+	disc.SendHeartbeat(service)
+	check("first read", false, false, false)
+
+	service.Tags = []string{"v2"}
+	check("tag change", false, true, false)
+
+	disc.UpdateStatus(service, discovery.StatusWarning, "slow")
+	check("passing to warning", true, true, true)
+	if len(status.instances) != 1 || status.instances[0].Status != discovery.StatusWarning {
+		t.Errorf("Expected warning instance for changeOn status but got %v", status.instances)
+	}
+	if len(addr.instances) != 0 {
+		t.Errorf("Expected no instances without changeOn status but got %v", addr.instances)
+	}
+}
+
+func TestUpstreamStatePerBackend(t *testing.T) {
+	disc := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[
+{"name": "app", "poll": 1, "onChange": "/bin/true", "tag": "blue"},
+{"name": "app", "poll": 1, "onChange": "/bin/true", "tag": "green"}
+]`), &raw)
+	backends, err := NewBackends(raw, disc)
+	if err != nil {
+		t.Fatalf("Could not parse backends JSON: %s", err)
+	}
+	blue, green := backends[0], backends[1]
+	disc.SetUpstreams("app", &discovery.ServiceDefinition{ID: "app-1", Name: "app",
+		IPAddress: "192.168.1.1", Port: 80, Tags: []string{"blue"}})
+	if blue.CheckForUpstreamChanges() || green.CheckForUpstreamChanges() {
+		t.Fatalf("First read of backends should show `false` for change")
+	}
+	disc.SetUpstreams("app",
+		&discovery.ServiceDefinition{ID: "app-1", Name: "app",
+			IPAddress: "192.168.1.1", Port: 80, Tags: []string{"blue"}},
+		&discovery.ServiceDefinition{ID: "app-2", Name: "app",
+			IPAddress: "192.168.1.2", Port: 80, Tags: []string{"green"}})
+	if blue.CheckForUpstreamChanges() {
+		t.Errorf("Expected no change for tag blue")
+	}
+	if !green.CheckForUpstreamChanges() {
+		t.Errorf("Expected change for tag green")
+	}
+
+	// backends created by a reload start over with their own state
+	reloaded, _ := NewBackends(raw, disc)
+	if reloaded[1].CheckForUpstreamChanges() {
+		t.Errorf("First read of reloaded backend should show `false` for change")
+	}
+	if instances := reloaded[1].upstream.Instances(); len(instances) != 1 || instances[0].ID != "app-2" {
+		t.Errorf("Expected reloaded backend to see app-2 but got %v", instances)
+	}
+}
+
+func TestBackendsFiltersParse(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "app", "poll": 1, "onChange": "/bin/true",
+ "tag": "web", "tags": ["prod", "web"]}]`), &raw)
+	backends, err := NewBackends(raw, memory.NewMemory())
+	if err != nil {
+		t.Fatalf("Could not parse backends JSON: %s", err)
+	}
+	if tags := backends[0].upstream.Tags; !reflect.DeepEqual(tags, []string{"web", "prod"}) {
+		t.Errorf("Expected tags [web prod] but got %v", tags)
+	}
+
+	json.Unmarshal([]byte(`[{"name": "app", "poll": 1, "onChange": "/bin/true",
+ "datacenter": "dc2", "nodeMeta": {"rack": "r1"}, "near": "_agent"}]`), &raw)
+	backends, err = NewBackends(raw, nil)
+	if err != nil {
+		t.Fatalf("Could not parse backends JSON: %s", err)
+	}
+	upstream := backends[0].upstream
+	if upstream.Datacenter != "dc2" || upstream.Near != "_agent" ||
+		upstream.NodeMeta["rack"] != "r1" {
+		t.Errorf("Expected node filters on upstream but got %+v", upstream)
+	}
+
+	_, err = NewBackends(raw, memory.NewMemory())
+	validateBackendConfigError(t, err,
+		"`datacenter` is not supported by the discovery service in backend app")
+}
+
+func TestBackendsWatchConfigError(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "watch": true, "maxWait": "xx"}]`), &raw)
+	_, err := NewBackends(raw, nil)
+	validateBackendConfigError(t, err,
+		"Could not parse `maxWait` in backend myName: time: invalid duration xx")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "onChange": "/bin/true", "watch": true, "maxWait": "10ms"}]`), &raw)
+	_, err = NewBackends(raw, nil)
+	validateBackendConfigError(t, err, "`maxWait` must be >= 1s in backend myName")
+}
+
 // ------------------------------------------
 // test helpers
 
+// newCountingBackend returns a backend whose onChange runs the script and
+// then appends a line to the returned file
+func newCountingBackend(t *testing.T, script string) (*Backend, string) {
+	dir, _ := ioutil.TempDir("", "containerpilot")
+	count := filepath.Join(dir, "count")
+	cmd, err := commands.NewCommand([]interface{}{"sh", "-c",
+		script + "echo >> $0", count}, "5s")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing command: %v", err)
+	}
+	return &Backend{Name: "counting", onChangeCmd: cmd,
+		upstream: discovery.NewUpstream("counting", "")}, count
+}
+
+func countRuns(count string) int {
+	buf, _ := ioutil.ReadFile(count)
+	return strings.Count(string(buf), "\n")
+}
+
 func validateCommandParsed(t *testing.T, name string, parsed *commands.Command,
 	expectedExec string, expectedArgs []string) {
 	if parsed == nil {
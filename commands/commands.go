@@ -1,12 +1,14 @@
 package commands
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,6 +26,8 @@ type Command struct {
 	Args            []string
 	Timeout         string
 	TimeoutDuration time.Duration
+	Env             []string // added to the environment of the process
+	Stdin           []byte   // written to the standard input of the process
 	ticker          *time.Ticker
 	logWriters      []io.WriteCloser
 }
@@ -143,13 +147,95 @@ func RunWithTimeout(c *Command, fields log.Fields) error {
 		return err
 	}
 
-	err := c.waitForTimeout()
+	_, err := c.waitForTimeout()
 	log.Debugf("%s.RunWithTimeout end", c.Name)
 	return err
 }
 
+// the most output we'll keep from RunWithTimeoutAndOutput, and how long
+// we'll wait for the output after the command exits
+const (
+	maxCapturedOutput = 4096
+	outputGracePeriod = time.Second
+)
+
+// RunWithTimeoutAndOutput runs the given command like RunWithTimeout,
+// but also captures the start of its stdout and stderr separately. The
+// stdout is logged as usual, but the stderr is left to the caller to log,
+// because whether it's worth more than a debug message depends on the
+// result. It returns the output and the exit code along with any error.
+func RunWithTimeoutAndOutput(c *Command, fields log.Fields) (string, string, int, error) {
+	if c == nil {
+		// sometimes this will be ok but we should return an error
+		// anyway in case the caller cares
+		return "", "", 1, errors.New("Command for RunWithTimeoutAndOutput was nil")
+	}
+	log.Debugf("%s.RunWithTimeoutAndOutput start", c.Name)
+	c.setUpCmd(fields)
+	defer c.closeLogs()
+	stdout := &cappedBuffer{limit: maxCapturedOutput}
+	stderr := &cappedBuffer{limit: maxCapturedOutput}
+	var dest io.Writer = stdout
+	if c.Cmd.Stdout != nil {
+		dest = io.MultiWriter(c.Cmd.Stdout, stdout)
+	}
+	// we read from our own pipes rather than letting exec copy the
+	// output, because waitForTimeout doesn't wait for exec's copying
+	// to finish and we'd lose the end of the output
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return "", "", 1, err
+	}
+	defer outR.Close()
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outW.Close()
+		return "", "", 1, err
+	}
+	defer errR.Close()
+	c.Cmd.Stdout = outW
+	c.Cmd.Stderr = errW
+	log.Debugf("%s.Cmd.Start", c.Name)
+	err = c.Cmd.Start()
+	outW.Close()
+	errW.Close()
+	if err != nil {
+		log.Errorf("Unable to start %s: %v", c.Name, err)
+		return "", "", 1, err
+	}
+	var copying sync.WaitGroup
+	copying.Add(2)
+	go func() {
+		defer copying.Done()
+		io.Copy(dest, outR)
+	}()
+	go func() {
+		defer copying.Done()
+		io.Copy(stderr, errR)
+	}()
+	copied := make(chan struct{})
+	go func() {
+		copying.Wait()
+		close(copied)
+	}()
+	code, err := c.waitForTimeout()
+	select {
+	case <-copied:
+	case <-time.After(outputGracePeriod):
+		// a child of the command may still hold the pipes open
+	}
+	log.Debugf("%s.RunWithTimeoutAndOutput end", c.Name)
+	return strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()), code, err
+}
+
 func (c *Command) setUpCmd(fields log.Fields) {
 	cmd := ArgsToCmd(c.Exec, c.Args)
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	if c.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.Stdin)
+	}
 	if fields != nil {
 		stdout := utils.NewLogWriter(fields, log.InfoLevel)
 		stderr := utils.NewLogWriter(fields, log.DebugLevel)
@@ -170,7 +256,8 @@ func (c *Command) Kill() error {
 	return nil
 }
 
-func (c *Command) waitForTimeout() error {
+// waitForTimeout waits for the process, returning its exit code
+func (c *Command) waitForTimeout() (int, error) {
 
 	quit := make(chan int)
 	cmd := c.Cmd
@@ -210,17 +297,49 @@ func (c *Command) waitForTimeout() error {
 	if err != nil {
 		if err.Error() == errNoChild {
 			log.Debugf(err.Error())
-			return nil // process exited cleanly before we hit wait4
+			return 0, nil // process exited cleanly before we hit wait4
 		}
 		log.Errorf("%s exited with error: %v", c.Name, err)
-		return err
+		return 1, err
 	}
 	if state != nil && !state.Success() {
-		return fmt.Errorf("%s exited with error", c.Name)
+		code := 1
+		if status, ok := state.Sys().(syscall.WaitStatus); ok {
+			code = status.ExitStatus()
+		}
+		return code, fmt.Errorf("%s exited with error", c.Name)
 	}
 
 	log.Debugf("%s.run complete", c.Name)
-	return nil
+	return 0, nil
+}
+
+// cappedBuffer is a goroutine-safe buffer that discards writes past
+// its limit, so that a chatty command can't use unbounded memory
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	lock  sync.Mutex
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if remain := b.limit - b.buf.Len(); remain > 0 {
+		if len(p) > remain {
+			b.buf.Write(p[:remain])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	// always report a full write or the command's output will be cut off
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
 }
 
 func (c *Command) closeLogs() {
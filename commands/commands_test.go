@@ -110,6 +110,35 @@ func TestRunWithTimeoutFailed(t *testing.T) {
 	}
 }
 
+func TestRunWithTimeoutAndOutput(t *testing.T) {
+	cmd, _ := NewCommand("./testdata/test.sh doStuff --debug", "1s")
+	output, stderr, code, err := RunWithTimeoutAndOutput(cmd, nil)
+	if code != 0 || err != nil {
+		t.Errorf("Expected exit (0,nil) but got (%d,%s)", code, err)
+	}
+	if output != "Running doStuff with args: --debug" || stderr != "" {
+		t.Errorf("Unexpected output: %q, %q", output, stderr)
+	}
+
+	cmd, _ = NewCommand("./testdata/test.sh failStuff", "1s")
+	output, _, code, err = RunWithTimeoutAndOutput(cmd, nil)
+	if code != 255 || err == nil {
+		t.Errorf("Expected exit (255,err) but got (%d,%s)", code, err)
+	}
+	if output != "Running failStuff with args:" {
+		t.Errorf("Unexpected output: %q", output)
+	}
+
+	cmd, _ = NewCommand("./testdata/test.sh errStuff", "1s")
+	output, stderr, code, err = RunWithTimeoutAndOutput(cmd, nil)
+	if code != 1 || err == nil {
+		t.Errorf("Expected exit (1,err) but got (%d,%s)", code, err)
+	}
+	if output != "Running errStuff with args:" || stderr != "Something went wrong" {
+		t.Errorf("Expected stdout and stderr apart but got %q, %q", output, stderr)
+	}
+}
+
 func TestEmptyCommand(t *testing.T) {
 	if cmd, err := NewCommand("", "0"); cmd != nil || err == nil {
 		t.Errorf("Expected exit (nil, err) but got %s, %s", cmd, err)
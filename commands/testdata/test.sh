@@ -20,6 +20,12 @@ failStuff() {
     exit -1
 }
 
+errStuff() {
+    echo "Running errStuff with args: $@"
+    echo "Something went wrong" 1>&2
+    exit 1
+}
+
 doNothing() {
   exit 0
 }
@@ -30,6 +30,7 @@ type rawConfig struct {
 	logConfig         *LogConfig
 	onStart           interface{}
 	preStart          interface{}
+	preStartLock      interface{}
 	preStop           interface{}
 	postStop          interface{}
 	stopTimeout       int
@@ -39,6 +40,7 @@ type rawConfig struct {
 	tasksConfig       []interface{}
 	telemetryConfig   interface{}
 	storagesConfig    []interface{}
+	controlConfig     interface{}
 }
 
 // Config contains the parsed config elements
@@ -46,6 +48,7 @@ type Config struct {
 	ServiceBackend discovery.ServiceBackend
 	LogConfig      *LogConfig
 	PreStart       *commands.Command
+	PreStartLock   *PreStartLock
 	PreStop        *commands.Command
 	PostStop       *commands.Command
 	StopTimeout    int
@@ -55,6 +58,7 @@ type Config struct {
 	Tasks          []*tasks.Task
 	Telemetry      *telemetry.Telemetry
 	Storages       []*storage.Storage
+	Control        *ControlConfig
 }
 
 const (
@@ -189,33 +193,41 @@ func (cfg *rawConfig) parseTasks() ([]*tasks.Task, error) {
 	return tasks, nil
 }
 
+// parseTaskLeaders restricts each task with a `leader` to run only on the
+// leader of that service
+func parseTaskLeaders(tasks []*tasks.Task, svcs []*services.Service) error {
+	for _, task := range tasks {
+		if task.Leader == "" {
+			continue
+		}
+		var leader *services.Service
+		for _, service := range svcs {
+			if service.Name == task.Leader && service.Leader {
+				leader = service
+				break
+			}
+		}
+		if leader == nil {
+			return fmt.Errorf("Task %s: `leader` must be a service with `leader` enabled: %s",
+				task.Name, task.Leader)
+		}
+		task.RequireLeader(leader.IsLeader)
+	}
+	return nil
+}
+
 // ParseConfig parses a raw config flag
 func ParseConfig(configFlag string) (*Config, error) {
 
 	log.Printf("config flag is: %v\n", configFlag)
-	if configFlag == "" {
-		return nil, errors.New("-config flag is required")
-	}
-
-	var data []byte
-	if strings.HasPrefix(configFlag, "file://") {
-		var err error
-		fName := strings.SplitAfter(configFlag, "file://")[1]
-		if data, err = ioutil.ReadFile(fName); err != nil {
-			return nil, fmt.Errorf("Could not read config file: %s", err)
-		}
-	} else {
-		data = []byte(configFlag)
+	data, err := readConfig(configFlag)
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Printf("containerpilot config data in json:%v\n", string(data))
 
-	template, err := ApplyTemplate(data)
-	if err != nil {
-		return nil, fmt.Errorf(
-			"Could not apply template to config: %v", err)
-	}
-	configMap, err := unmarshalConfig(template)
+	configMap, err := applyAndUnmarshal(data)
 	if err != nil {
 		return nil, err
 	}
@@ -243,6 +255,15 @@ func ParseConfig(configFlag string) (*Config, error) {
 	}
 	cfg.PreStart = preStartCmd
 
+	preStartLock, err := NewPreStartLockConfig(raw.preStartLock, discoveryService)
+	if err != nil {
+		return nil, err
+	}
+	if preStartLock != nil && preStartCmd == nil {
+		return nil, errors.New("`preStartLock` requires `preStart`")
+	}
+	cfg.PreStartLock = preStartLock
+
 	preStopCmd, err := raw.parsePreStop()
 	if err != nil {
 		return nil, err
@@ -305,6 +326,9 @@ func ParseConfig(configFlag string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := parseTaskLeaders(tasks, cfg.Services); err != nil {
+		return nil, err
+	}
 	cfg.Tasks = tasks
 
 	coprocesses, err := raw.parseCoprocesses()
@@ -313,9 +337,41 @@ func ParseConfig(configFlag string) (*Config, error) {
 	}
 	cfg.Coprocesses = coprocesses
 
+	control, err := NewControlConfig(raw.controlConfig)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Control = control
+
 	return cfg, nil
 }
 
+// Reads the config from the file:// path or returns the raw
+// config flag itself
+func readConfig(configFlag string) ([]byte, error) {
+	if configFlag == "" {
+		return nil, errors.New("-config flag is required")
+	}
+	if strings.HasPrefix(configFlag, "file://") {
+		fName := strings.SplitAfter(configFlag, "file://")[1]
+		data, err := ioutil.ReadFile(fName)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read config file: %s", err)
+		}
+		return data, nil
+	}
+	return []byte(configFlag), nil
+}
+
+func applyAndUnmarshal(data []byte) (map[string]interface{}, error) {
+	template, err := ApplyTemplate(data)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Could not apply template to config: %v", err)
+	}
+	return unmarshalConfig(template)
+}
+
 func unmarshalConfig(data []byte) (map[string]interface{}, error) {
 	var config map[string]interface{}
 	if err := json.Unmarshal(data, &config); err != nil {
@@ -401,6 +457,7 @@ func decodeConfig(configMap map[string]interface{}, result *rawConfig) error {
 	result.logConfig = &logConfig
 	result.onStart = configMap["onStart"]
 	result.preStart = configMap["preStart"]
+	result.preStartLock = configMap["preStartLock"]
 	result.preStop = configMap["preStop"]
 	result.postStop = configMap["postStop"]
 	result.servicesConfig = decodeArray(configMap["services"])
@@ -409,10 +466,12 @@ func decodeConfig(configMap map[string]interface{}, result *rawConfig) error {
 	result.coprocessesConfig = decodeArray(configMap["coprocesses"])
 	result.telemetryConfig = configMap["telemetry"]
 	result.storagesConfig = decodeArray(configMap["kvStorages"])
+	result.controlConfig = configMap["control"]
 
 	delete(configMap, "logging")
 	delete(configMap, "onStart")
 	delete(configMap, "preStart")
+	delete(configMap, "preStartLock")
 	delete(configMap, "preStop")
 	delete(configMap, "postStop")
 	delete(configMap, "stopTimeout")
@@ -422,6 +481,7 @@ func decodeConfig(configMap map[string]interface{}, result *rawConfig) error {
 	delete(configMap, "coprocesses")
 	delete(configMap, "telemetry")
 	delete(configMap, "kvStorages")
+	delete(configMap, "control")
 	var unused []string
 	for key := range configMap {
 		unused = append(unused, key)
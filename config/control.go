@@ -0,0 +1,65 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/toming90/containerpilot/utils"
+)
+
+// ControlConfig configures the control socket used to drive a
+// running ContainerPilot
+type ControlConfig struct {
+	SocketPath      string `mapstructure:"socket"`
+	MaintenanceFile string `mapstructure:"maintenanceFile"`
+}
+
+const (
+	defaultSocketPath      = "/var/run/containerpilot.socket"
+	defaultMaintenanceFile = "/var/run/containerpilot.maintenance"
+)
+
+// NewControlConfig parses the raw control config, applying defaults. The
+// control socket is only enabled when the config has a control key, so a
+// nil config returns nil.
+func NewControlConfig(raw interface{}) (*ControlConfig, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	cfg := &ControlConfig{
+		SocketPath:      defaultSocketPath,
+		MaintenanceFile: defaultMaintenanceFile,
+	}
+	if err := utils.DecodeRaw(raw, cfg); err != nil {
+		return nil, fmt.Errorf("Control configuration error: %v", err)
+	}
+	if cfg.SocketPath == "" {
+		cfg.SocketPath = defaultSocketPath
+	}
+	if cfg.MaintenanceFile == "" {
+		cfg.MaintenanceFile = defaultMaintenanceFile
+	}
+	return cfg, nil
+}
+
+// ParseControlConfig reads only the control config from the raw config
+// flag, so that the CLI client can find the socket without setting up
+// the rest of the configuration.
+func ParseControlConfig(configFlag string) (*ControlConfig, error) {
+	data, err := readConfig(configFlag)
+	if err != nil {
+		return nil, err
+	}
+	configMap, err := applyAndUnmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := NewControlConfig(configMap["control"])
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, errors.New("No control socket configured")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import "testing"
+
+func TestControlConfigDefaults(t *testing.T) {
+	cfg, err := NewControlConfig(nil)
+	if err != nil || cfg != nil {
+		t.Fatalf("Expected no control config but got %v (%v)", cfg, err)
+	}
+	cfg, err = NewControlConfig(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.SocketPath != defaultSocketPath {
+		t.Errorf("Expected default socket %s but got %s", defaultSocketPath, cfg.SocketPath)
+	}
+	if cfg.MaintenanceFile != defaultMaintenanceFile {
+		t.Errorf("Expected default maintenance file %s but got %s",
+			defaultMaintenanceFile, cfg.MaintenanceFile)
+	}
+	cfg, err = NewControlConfig(map[string]interface{}{"socket": "/tmp/cp.socket"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.SocketPath != "/tmp/cp.socket" {
+		t.Errorf("Expected socket /tmp/cp.socket but got %s", cfg.SocketPath)
+	}
+	if _, err = NewControlConfig(map[string]interface{}{"sock": "x"}); err == nil {
+		t.Errorf("Expected error for unknown control key")
+	}
+}
+
+func TestParseControlConfig(t *testing.T) {
+	cfg, err := ParseControlConfig(`{"consul": "consul:8500", "control": {"socket": "/tmp/x.socket"}}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.SocketPath != "/tmp/x.socket" {
+		t.Errorf("Expected socket /tmp/x.socket but got %s", cfg.SocketPath)
+	}
+	if _, err = ParseControlConfig(`{"consul": "consul:8500"}`); err == nil {
+		t.Errorf("Expected error for missing control config")
+	}
+	if _, err = ParseControlConfig(""); err == nil {
+		t.Errorf("Expected error for missing config")
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/utils"
+)
+
+// PreStartLock configures a named lock, held through the discovery
+// service, that must be taken before the preStart command runs and is
+// released when it exits. Containers sharing the same lock name run their
+// preStart one at a time.
+type PreStartLock struct {
+	Name            string `mapstructure:"name"`
+	TTL             int    `mapstructure:"ttl"`
+	Timeout         string `mapstructure:"timeout"`
+	TimeoutDuration time.Duration
+}
+
+// the default TTL of the preStart lock, in seconds
+const defaultPreStartLockTTL = 10
+
+// NewPreStartLockConfig parses the raw preStartLock config, which
+// requires a discovery service that can hold locks
+func NewPreStartLockConfig(raw interface{},
+	disc discovery.ServiceBackend) (*PreStartLock, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	cfg := &PreStartLock{}
+	if err := utils.DecodeRaw(raw, cfg); err != nil {
+		return nil, fmt.Errorf("`preStartLock` configuration error: %v", err)
+	}
+	if cfg.Name == "" {
+		return nil, errors.New("`name` is required in `preStartLock`")
+	}
+	if cfg.TTL < 0 {
+		return nil, errors.New("`ttl` must be > 0 in `preStartLock`")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultPreStartLockTTL
+	}
+	if cfg.Timeout != "" {
+		timeout, err := utils.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse `timeout` in `preStartLock`: %s", err)
+		}
+		cfg.TimeoutDuration = timeout
+	}
+	if _, ok := disc.(discovery.Locker); !ok {
+		return nil, errors.New("`preStartLock` is not supported by the discovery service")
+	}
+	return cfg, nil
+}
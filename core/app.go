@@ -1,8 +1,10 @@
 package core
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"sync"
@@ -32,23 +34,31 @@ var (
 // App encapsulates the state of ContainerPilot after the initial setup.
 // after it is run, it can be reloaded and paused with signals.
 type App struct {
-	ServiceBackend discovery.ServiceBackend
-	Services       []*services.Service
-	Backends       []*backends.Backend
-	Tasks          []*tasks.Task
-	Coprocesses    []*coprocesses.Coprocess
-	Telemetry      *telemetry.Telemetry
-	PreStartCmd    *commands.Command
-	PreStopCmd     *commands.Command
-	PostStopCmd    *commands.Command
-	Command        *commands.Command
-	StopTimeout    int
-	QuitChannels   []chan bool
-	maintModeLock  *sync.RWMutex
-	signalLock     *sync.RWMutex
-	paused         bool
-	ConfigFlag     string
-	Storages       []*storage.Storage
+	ServiceBackend  discovery.ServiceBackend
+	Services        []*services.Service
+	Backends        []*backends.Backend
+	Tasks           []*tasks.Task
+	Coprocesses     []*coprocesses.Coprocess
+	Telemetry       *telemetry.Telemetry
+	PreStartCmd     *commands.Command
+	PreStartLock    *config.PreStartLock
+	PreStopCmd      *commands.Command
+	PostStopCmd     *commands.Command
+	Command         *commands.Command
+	StopTimeout     int
+	QuitChannels    []chan bool
+	maintModeLock   *sync.RWMutex
+	signalLock      *sync.RWMutex
+	paused          bool
+	pauseReason     string
+	ConfigFlag      string
+	Storages        []*storage.Storage
+	Control         *config.ControlConfig
+	controlListener net.Listener
+	startedAt       time.Time
+	stopWaiting     chan struct{}
+	stopWaitingOnce *sync.Once
+	lockHolder      string
 }
 
 // EmptyApp creates an empty application
@@ -56,6 +66,8 @@ func EmptyApp() *App {
 	app := &App{}
 	app.maintModeLock = &sync.RWMutex{}
 	app.signalLock = &sync.RWMutex{}
+	app.stopWaiting = make(chan struct{})
+	app.stopWaitingOnce = &sync.Once{}
 	return app
 }
 
@@ -64,12 +76,27 @@ func LoadApp() (*App, error) {
 
 	var configFlag string
 	var versionFlag bool
+	var reloadFlag bool
+	var maintFlag string
+	var serviceFlag string
+	var reasonFlag string
+	var statusFlag bool
 
 	if !flag.Parsed() {
 
 		flag.StringVar(&configFlag, "config", "",
 			"JSON config or file:// path to JSON config file.")
 		flag.BoolVar(&versionFlag, "version", false, "Show version identifier and quit.")
+		flag.BoolVar(&reloadFlag, "reload", false,
+			"Reload the config of the running ContainerPilot and quit.")
+		flag.StringVar(&maintFlag, "maintenance", "",
+			"'enable' or 'disable' maintenance mode of the running ContainerPilot and quit.")
+		flag.StringVar(&serviceFlag, "service", "",
+			"Limit -maintenance to a single service.")
+		flag.StringVar(&reasonFlag, "reason", "",
+			"Reason for -maintenance, shown by discovery services that support it.")
+		flag.BoolVar(&statusFlag, "status", false,
+			"Print the status of the running ContainerPilot as JSON and quit.")
 		flag.Parse()
 	}
 	if versionFlag {
@@ -79,6 +106,15 @@ func LoadApp() (*App, error) {
 	if configFlag == "" {
 		configFlag = os.Getenv("CONTAINERPILOT")
 	}
+	if reloadFlag || maintFlag != "" || statusFlag {
+		err := runControlCommand(configFlag, reloadFlag, maintFlag, serviceFlag,
+			reasonFlag, statusFlag)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	os.Setenv("CONTAINERPILOT_PID", fmt.Sprintf("%v", os.Getpid()))
 
@@ -102,6 +138,7 @@ func NewApp(configFlag string) (*App, error) {
 	}
 
 	a.PreStartCmd = cfg.PreStart
+	a.PreStartLock = cfg.PreStartLock
 	a.PreStopCmd = cfg.PreStop
 	a.PostStopCmd = cfg.PostStop
 	a.StopTimeout = cfg.StopTimeout
@@ -113,6 +150,7 @@ func NewApp(configFlag string) (*App, error) {
 	a.Telemetry = cfg.Telemetry
 	a.ConfigFlag = configFlag
 	a.Storages = cfg.Storages
+	a.Control = cfg.Control
 
 	// set an environment variable for each service IP address so that
 	// forked processes have access to this information
@@ -147,15 +185,24 @@ func (a *App) Run() {
 	a.Command = cmd
 
 	a.handleSignals()
+	a.serveControl()
 
-	if a.PreStartCmd != nil {
-		// Run the preStart handler, if any, and exit if it returns an error
-		fields := log.Fields{"process": "PreStart"}
-		if code, err := commands.RunAndWait(a.PreStartCmd, fields); err != nil {
-			os.Exit(code)
-		}
+	// Run the preStart handler, if any, and exit if it returns an error
+	if code, err := a.runPreStart(); err != nil {
+		os.Exit(code)
+	}
+	if err := a.checkServiceIDs(); err != nil {
+		log.Error(err)
+		os.Exit(1)
 	}
 	a.handleCoprocesses()
+	if err := a.waitForBackends(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	// services' `initialDelay` counts from the start of the main process,
+	// and is not reset by a reload
+	a.startedAt = time.Now()
 	a.handlePolling()
 
 	if a.Command != nil {
@@ -181,6 +228,54 @@ func (a *App) Run() {
 	select {}
 }
 
+// checkServiceIDs returns an error if the ID of any service is already
+// registered by another instance, which we'd otherwise silently overwrite
+func (a *App) checkServiceIDs() error {
+	for _, service := range a.Services {
+		if err := service.CheckID(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForBackends blocks until each `required` backend has enough healthy
+// instances. Backends that time out with `onRequiredTimeout` of
+// `continue` are logged; otherwise the first error is returned.
+func (a *App) waitForBackends() error {
+	var required []*backends.Backend
+	for _, backend := range a.Backends {
+		if backend.Required {
+			required = append(required, backend)
+		}
+	}
+	errs := make([]error, len(required))
+	var wg sync.WaitGroup
+	for i, backend := range required {
+		wg.Add(1)
+		go func(i int, backend *backends.Backend) {
+			defer wg.Done()
+			errs[i] = backend.WaitForInstances(a.stopWaiting)
+		}(i, backend)
+	}
+	wg.Wait()
+	select {
+	case <-a.stopWaiting:
+		return errors.New("Terminated while waiting for required backends")
+	default:
+	}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if required[i].OnTimeout != backends.OnTimeoutContinue {
+			return err
+		}
+		log.Warnf("%s, starting anyway", err)
+	}
+	return nil
+}
+
 // Render the command line args thru golang templating so we can
 // interpolate environment variables
 func getArgs(args []string) []string {
@@ -197,18 +292,79 @@ func getArgs(args []string) []string {
 	return renderedArgs
 }
 
-// ToggleMaintenanceMode marks all services for maintenance
-func (a *App) ToggleMaintenanceMode() {
-	a.maintModeLock.RLock()
+// ToggleMaintenanceMode marks all services for maintenance, giving the
+// reason to discovery services with their own maintenance mode
+func (a *App) ToggleMaintenanceMode(reason string) {
 	a.signalLock.Lock()
 	defer a.signalLock.Unlock()
-	defer a.maintModeLock.RUnlock()
-	a.paused = !a.paused
-	if a.paused {
-		a.forAllServices(markServiceForMaintenance)
+	a.setMaintenanceMode(!a.InMaintenanceMode(), reason)
+}
+
+// EnterMaintenanceMode marks all services for maintenance. Unlike
+// ToggleMaintenanceMode, it has no effect if we're already paused.
+func (a *App) EnterMaintenanceMode(reason string) {
+	a.signalLock.Lock()
+	defer a.signalLock.Unlock()
+	if !a.InMaintenanceMode() {
+		a.setMaintenanceMode(true, reason)
 	}
 }
 
+// ExitMaintenanceMode resumes polling for all services
+func (a *App) ExitMaintenanceMode() {
+	a.signalLock.Lock()
+	defer a.signalLock.Unlock()
+	a.setMaintenanceMode(false, "")
+}
+
+func (a *App) setMaintenanceMode(paused bool, reason string) {
+	a.maintModeLock.Lock()
+	a.paused = paused
+	a.pauseReason = reason
+	a.maintModeLock.Unlock()
+	if paused {
+		a.forAllServices(func(service *services.Service) {
+			log.Infof("Marking for maintenance: %s", service.Name)
+			service.MarkForMaintenance(reason)
+		})
+	} else {
+		a.forAllServices(clearServiceMaintenance)
+	}
+}
+
+// SetServiceMaintenance puts a single service into or out of maintenance
+// mode without pausing the rest of the App
+func (a *App) SetServiceMaintenance(name string, enabled bool, reason string) error {
+	a.signalLock.Lock()
+	defer a.signalLock.Unlock()
+	return a.setServiceMaintenance(name, reason, func(bool) bool { return enabled })
+}
+
+// ToggleServiceMaintenance puts a single service into maintenance mode,
+// or takes it out if it's already in maintenance
+func (a *App) ToggleServiceMaintenance(name, reason string) error {
+	a.signalLock.Lock()
+	defer a.signalLock.Unlock()
+	return a.setServiceMaintenance(name, reason, func(current bool) bool { return !current })
+}
+
+// setServiceMaintenance sets the maintenance mode of the named service to
+// the result of fn, which is passed its current mode
+func (a *App) setServiceMaintenance(name, reason string, fn func(bool) bool) error {
+	for _, service := range a.Services {
+		if service.Name == name {
+			if fn(service.InMaintenance()) {
+				log.Infof("Marking for maintenance: %s", service.Name)
+				service.EnterMaintenance(reason)
+			} else {
+				service.ExitMaintenance()
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("No such service: %s", name)
+}
+
 // InMaintenanceMode checks if the App is in maintenance mode
 func (a *App) InMaintenanceMode() bool {
 	// we wrap access to `paused` in a RLock so that if we're in the middle of
@@ -222,7 +378,9 @@ func (a *App) InMaintenanceMode() bool {
 func (a *App) Terminate() {
 	a.signalLock.Lock()
 	defer a.signalLock.Unlock()
+	a.stopWaitingOnce.Do(func() { close(a.stopWaiting) })
 	a.stopPolling()
+	a.stopControl()
 	a.forAllServices(deregisterService)
 
 	// Run and wait for preStop command to exit (continues
@@ -255,9 +413,12 @@ func (a *App) stopPolling() {
 	}
 }
 
-func markServiceForMaintenance(service *services.Service) {
-	log.Infof("Marking for maintenance: %s", service.Name)
-	service.MarkForMaintenance()
+// clearServiceMaintenance takes the service out of maintenance in the
+// discovery service, unless it's been put into maintenance by itself
+func clearServiceMaintenance(service *services.Service) {
+	if !service.InMaintenance() {
+		service.ClearMaintenance()
+	}
 }
 
 func deregisterService(service *services.Service) {
@@ -279,19 +440,63 @@ func (a *App) Reload() error {
 		return err
 	}
 
+	// stop the old backends before their poll loops do, so that we know
+	// which had an onChange waiting out its debounce period
+	pending := map[string]bool{}
+	for _, backend := range a.Backends {
+		if backend.StopChanges() {
+			pending[backend.Name] = true
+		}
+	}
 	a.stopPolling()
 	a.forAllServices(deregisterService)
 	a.stopCoprocesses()
 
 	a.load(newApp)
+	for _, backend := range a.Backends {
+		if pending[backend.Name] {
+			// don't lose a change seen just before the reload
+			backend.Changed()
+		}
+	}
 	return nil
 }
 
 func (a *App) load(newApp *App) {
+	// the old services have been deregistered, so nothing else needs the
+	// old discovery service's connections
+	if closer, ok := a.ServiceBackend.(discovery.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Warnf("Error closing discovery service: %v", err)
+		}
+	}
 	a.ServiceBackend = newApp.ServiceBackend
 	a.PostStopCmd = newApp.PostStopCmd
 	a.PreStopCmd = newApp.PreStopCmd
+	// the new services start out of maintenance, so services that were
+	// put into maintenance by themselves or with the rest of the App are
+	// marked for maintenance again, by name, before polling restarts
+	maintenance := map[string]string{}
+	for _, service := range a.Services {
+		if service.InMaintenance() {
+			maintenance[service.Name] = service.MaintenanceReason()
+		}
+	}
 	a.Services = newApp.Services
+	a.maintModeLock.RLock()
+	paused, pauseReason := a.paused, a.pauseReason
+	a.maintModeLock.RUnlock()
+	for _, service := range a.Services {
+		if reason, ok := maintenance[service.Name]; ok {
+			log.Infof("Marking for maintenance: %s", service.Name)
+			service.EnterMaintenance(reason)
+		} else if paused {
+			log.Infof("Marking for maintenance: %s", service.Name)
+			service.MarkForMaintenance(pauseReason)
+		}
+	}
+	// the new backends start over with no state from the discovery
+	// service, so their first check doesn't fire onChange
 	a.Backends = newApp.Backends
 	a.StopTimeout = newApp.StopTimeout
 	a.Storages = newApp.Storages
@@ -318,10 +523,18 @@ func (a *App) forAllServices(fn serviceFunc) {
 func (a *App) handlePolling() {
 	var quit []chan bool
 	for _, backend := range a.Backends {
-		quit = append(quit, a.poll(backend))
+		if backend.Watching() {
+			quit = append(quit, a.watch(backend))
+		} else {
+			quit = append(quit, a.poll(backend))
+		}
 	}
 	for _, service := range a.Services {
+		service.SetStartTime(a.startedAt)
 		quit = append(quit, a.poll(service))
+		for _, check := range service.Checks {
+			quit = append(quit, a.poll(check))
+		}
 	}
 
 	// CUSTOMIZE - polling storage change
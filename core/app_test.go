@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/memory"
 )
 
 // ------------------------------------------
@@ -244,6 +246,101 @@ func TestMetricServiceCreation(t *testing.T) {
 	}
 }
 
+func TestMemoryBackendApp(t *testing.T) {
+	app, err := NewApp(`{
+    "memory": {},
+    "services": [{"name": "app", "port": 8080, "poll": 1, "ttl": 1,
+                  "interfaces": "static:192.168.1.100"}],
+    "backends": [{"name": "app", "poll": 1, "onChange": "/bin/true"}]
+  }`)
+	if err != nil {
+		t.Fatalf("Got error while initializing config: %v", err)
+	}
+	backend, ok := app.ServiceBackend.(*memory.Memory)
+	if !ok {
+		t.Fatalf("Expected memory backend but got %T", app.ServiceBackend)
+	}
+	service := app.Services[0]
+	if app.Backends[0].CheckForUpstreamChanges() {
+		t.Errorf("First read of backend should show `false` for change")
+	}
+	service.PollAction()
+	if !backend.IsRegistered(service.ID) {
+		t.Fatalf("Expected service to be registered: %v", backend.Calls())
+	}
+	if !app.Backends[0].CheckForUpstreamChanges() {
+		t.Errorf("Expected backend to see the service register")
+	}
+}
+
+func TestReloadKeepsMaintenance(t *testing.T) {
+	app, err := NewApp(`{
+    "memory": {},
+    "services": [
+      {"name": "app", "port": 8080, "poll": 1, "ttl": 1,
+       "interfaces": "static:192.168.1.100"},
+      {"name": "other", "port": 9090, "poll": 1, "ttl": 1,
+       "interfaces": "static:192.168.1.100"}
+    ]
+  }`)
+	if err != nil {
+		t.Fatalf("Got error while initializing config: %v", err)
+	}
+	if err := app.SetServiceMaintenance("app", true, "upgrading"); err != nil {
+		t.Fatalf("Unexpected error entering maintenance: %v", err)
+	}
+	if err := app.Reload(); err != nil {
+		t.Fatalf("Unexpected error reloading: %v", err)
+	}
+	defer app.stopPolling()
+
+	backend := app.ServiceBackend.(*memory.Memory)
+	service := app.Services[0]
+	if !service.InMaintenance() || service.MaintenanceReason() != "upgrading" {
+		t.Errorf("Expected reloaded service to stay in maintenance for %q but got %v %q",
+			"upgrading", service.InMaintenance(), service.MaintenanceReason())
+	}
+	if backend.CallCount(memory.MarkForMaintenance, service.ID) != 1 {
+		t.Errorf("Expected reloaded service to be marked for maintenance: %v",
+			backend.Calls())
+	}
+	if app.Services[1].InMaintenance() {
+		t.Errorf("Expected other service to stay out of maintenance")
+	}
+}
+
+func TestWaitForBackends(t *testing.T) {
+	app, err := NewApp(`{
+    "memory": {},
+    "backends": [
+      {"name": "db", "poll": 1, "onChange": "/bin/true", "required": true},
+      {"name": "cache", "poll": 1, "onChange": "/bin/true", "required": true,
+       "requiredTimeout": "100ms", "onRequiredTimeout": "continue"}
+    ]
+  }`)
+	if err != nil {
+		t.Fatalf("Got error while initializing config: %v", err)
+	}
+	backend := app.ServiceBackend.(*memory.Memory)
+	backend.SetUpstreams("db", &discovery.ServiceDefinition{
+		ID: "db-1", Name: "db", IPAddress: "192.168.1.1", Port: 5432})
+	if err := app.waitForBackends(); err != nil {
+		t.Errorf("Expected timed out backend to continue but got %v", err)
+	}
+
+	app.Backends[1].OnTimeout = "exit"
+	if err := app.waitForBackends(); err == nil {
+		t.Errorf("Expected error for timed out backend but got nil")
+	}
+
+	app.Backends[1].RequiredTimeout = ""
+	app.Terminate()
+	if err := app.waitForBackends(); err == nil ||
+		err.Error() != "Terminated while waiting for required backends" {
+		t.Errorf("Expected terminated error but got %v", err)
+	}
+}
+
 func TestPidEnvVar(t *testing.T) {
 	defer argTestCleanup(argTestSetup())
 	os.Args = []string{"this", "-config", "{}", "/testdata/test.sh"}
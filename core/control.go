@@ -0,0 +1,297 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/config"
+)
+
+// Status is the JSON body returned by the control socket's status endpoint
+type Status struct {
+	Version     string            `json:"version"`
+	Maintenance bool              `json:"maintenance"`
+	Services    []ServiceStatus   `json:"services"`
+	Backends    []BackendStatus   `json:"backends"`
+	Tasks       []TaskStatus      `json:"tasks"`
+	Coprocesses []CoprocessStatus `json:"coprocesses"`
+}
+
+// ServiceStatus is the status of a single service
+type ServiceStatus struct {
+	Name    string        `json:"name"`
+	ID      string        `json:"id"`
+	Address string        `json:"address"`
+	Port    int           `json:"port"`
+	Status  string        `json:"status"`
+	Role    string        `json:"role,omitempty"`
+	Checks  []CheckStatus `json:"checks,omitempty"`
+}
+
+// CheckStatus is the status of one of the named checks of a service
+type CheckStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// BackendStatus is the status of a single backend
+type BackendStatus struct {
+	Name  string `json:"name"`
+	Tag   string `json:"tag,omitempty"`
+	Poll  int    `json:"poll"`
+	Watch bool   `json:"watch"`
+}
+
+// TaskStatus is the status of a single task
+type TaskStatus struct {
+	Name      string `json:"name"`
+	Frequency string `json:"frequency"`
+	Leader    string `json:"leader,omitempty"`
+}
+
+// CoprocessStatus is the status of a single coprocess
+type CoprocessStatus struct {
+	Name string `json:"name"`
+}
+
+// serveControl starts the HTTP API on the control socket. Like the
+// telemetry server, the listener is not replaced on reload.
+func (a *App) serveControl() {
+	if a.Control == nil || a.controlListener != nil {
+		return
+	}
+	path := a.Control.SocketPath
+	if err := removeStaleSocket(path); err != nil {
+		log.Errorf("control: %v", err)
+		return
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Errorf("control: unable to listen on %s: %v", path, err)
+		return
+	}
+	a.controlListener = ln
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", a.handleReload)
+	mux.HandleFunc("/maintenance/enable", a.handleMaintenance(true))
+	mux.HandleFunc("/maintenance/disable", a.handleMaintenance(false))
+	mux.HandleFunc("/status", a.handleStatus)
+	go func() {
+		log.Infof("control: Listening on %s", path)
+		if err := http.Serve(ln, mux); err != nil {
+			log.Debugf("control: Stopped listening on %s: %v", path, err)
+		}
+	}()
+}
+
+// removeStaleSocket cleans up a socket left behind by an unclean exit.
+// Anything at the path that isn't a socket is left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to stat %s: %v", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %s: not a socket", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove stale socket %s: %v", path, err)
+	}
+	return nil
+}
+
+// stopControl closes the control socket
+func (a *App) stopControl() {
+	if a.controlListener == nil {
+		return
+	}
+	if err := a.controlListener.Close(); err != nil {
+		log.Warnf("control: error closing socket: %v", err)
+	}
+	a.controlListener = nil
+}
+
+func (a *App) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Infof("control: reload requested")
+	if err := a.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleMaintenance toggles maintenance mode for all services, or for
+// just one service if the `service` query parameter is given
+func (a *App) handleMaintenance(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("service")
+		reason := r.URL.Query().Get("reason")
+		log.Infof("control: maintenance enabled=%v requested for %q", enabled, name)
+		if name != "" {
+			if err := a.SetServiceMaintenance(name, enabled, reason); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		} else if enabled {
+			a.EnterMaintenanceMode(reason)
+		} else {
+			a.ExitMaintenanceMode()
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (a *App) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(a.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Status returns a snapshot of the state of the App
+func (a *App) Status() *Status {
+	a.signalLock.RLock()
+	defer a.signalLock.RUnlock()
+	status := &Status{
+		Version:     Version,
+		Maintenance: a.InMaintenanceMode(),
+		Services:    []ServiceStatus{},
+		Backends:    []BackendStatus{},
+		Tasks:       []TaskStatus{},
+		Coprocesses: []CoprocessStatus{},
+	}
+	for _, service := range a.Services {
+		serviceStatus := ServiceStatus{
+			Name:    service.Name,
+			ID:      service.ID,
+			Address: service.IPAddress,
+			Port:    service.Port,
+			Status:  service.Status(),
+			Role:    service.Role(),
+		}
+		for _, check := range service.Checks {
+			serviceStatus.Checks = append(serviceStatus.Checks, CheckStatus{
+				Name:   check.Name,
+				Status: check.Status(),
+			})
+		}
+		status.Services = append(status.Services, serviceStatus)
+	}
+	for _, backend := range a.Backends {
+		status.Backends = append(status.Backends, BackendStatus{
+			Name:  backend.Name,
+			Tag:   backend.Tag,
+			Poll:  backend.Poll,
+			Watch: backend.Watch,
+		})
+	}
+	for _, task := range a.Tasks {
+		status.Tasks = append(status.Tasks, TaskStatus{
+			Name:      task.Name,
+			Frequency: task.Frequency,
+			Leader:    task.Leader,
+		})
+	}
+	for _, coprocess := range a.Coprocesses {
+		status.Coprocesses = append(status.Coprocesses, CoprocessStatus{
+			Name: coprocess.Name,
+		})
+	}
+	return status
+}
+
+// runControlCommand sends a single request to the control socket of a
+// running ContainerPilot, printing the response body on success
+func runControlCommand(configFlag string, reload bool, maintenance, service, reason string,
+	status bool) error {
+	cfg, err := config.ParseControlConfig(configFlag)
+	if err != nil {
+		return err
+	}
+	var method, path string
+	switch {
+	case reload:
+		method, path = "POST", "/reload"
+	case maintenance == "enable" || maintenance == "disable":
+		method, path = "POST", "/maintenance/"+maintenance
+		query := url.Values{}
+		if service != "" {
+			query.Set("service", service)
+		}
+		if reason != "" && maintenance == "enable" {
+			query.Set("reason", reason)
+		}
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+	case maintenance != "":
+		return fmt.Errorf("-maintenance must be 'enable' or 'disable', got %q", maintenance)
+	case status:
+		method, path = "GET", "/status"
+	default:
+		return errors.New("no control command given")
+	}
+	body, err := controlRequest(cfg.SocketPath, method, path)
+	if err != nil {
+		return err
+	}
+	if body != "" {
+		fmt.Println(body)
+	}
+	return nil
+}
+
+// controlRequest makes an HTTP request over the control socket
+func controlRequest(socketPath, method, path string) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://control"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Could not reach ContainerPilot at %s: %v", socketPath, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s failed (%d): %s", method, path,
+			resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
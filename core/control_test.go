@@ -0,0 +1,115 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/toming90/containerpilot/config"
+)
+
+func TestControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containerpilot")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "containerpilot.socket")
+
+	app := getSignalTestConfig()
+	app.Control = &config.ControlConfig{SocketPath: socket}
+	app.serveControl()
+	defer app.stopControl()
+
+	body, err := controlRequest(socket, "GET", "/status")
+	if err != nil {
+		t.Fatalf("Unexpected error getting status: %v", err)
+	}
+	status := &Status{}
+	if err := json.Unmarshal([]byte(body), status); err != nil {
+		t.Fatalf("Could not decode status %s: %v", body, err)
+	}
+	if status.Maintenance || len(status.Services) != 1 ||
+		status.Services[0].Name != "test-service" {
+		t.Errorf("Unexpected status: %s", body)
+	}
+
+	if _, err := controlRequest(socket, "POST", "/maintenance/enable?service=test-service"); err != nil {
+		t.Fatalf("Unexpected error entering service maintenance: %v", err)
+	}
+	if app.InMaintenanceMode() || !app.Services[0].InMaintenance() {
+		t.Errorf("Expected only test-service to be in maintenance")
+	}
+	if _, err := controlRequest(socket, "POST", "/maintenance/disable?service=test-service"); err != nil {
+		t.Fatalf("Unexpected error exiting service maintenance: %v", err)
+	}
+	if app.Services[0].InMaintenance() {
+		t.Errorf("Expected test-service to be out of maintenance")
+	}
+
+	if _, err := controlRequest(socket, "POST", "/maintenance/enable"); err != nil {
+		t.Fatalf("Unexpected error entering maintenance: %v", err)
+	}
+	if !app.InMaintenanceMode() {
+		t.Errorf("Expected app to be in maintenance")
+	}
+	// entering maintenance again should not toggle it off
+	controlRequest(socket, "POST", "/maintenance/enable")
+	if !app.InMaintenanceMode() {
+		t.Errorf("Expected app to still be in maintenance")
+	}
+	if _, err := controlRequest(socket, "POST", "/maintenance/disable"); err != nil {
+		t.Fatalf("Unexpected error exiting maintenance: %v", err)
+	}
+	if app.InMaintenanceMode() {
+		t.Errorf("Expected app to be out of maintenance")
+	}
+
+	_, err = controlRequest(socket, "POST", "/maintenance/enable?service=nope")
+	if err == nil || !strings.Contains(err.Error(), "No such service: nope") {
+		t.Errorf("Expected error for unknown service but got %v", err)
+	}
+	_, err = controlRequest(socket, "GET", "/reload")
+	if err == nil || !strings.Contains(err.Error(), "405") {
+		t.Errorf("Expected method not allowed for GET /reload but got %v", err)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containerpilot")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := removeStaleSocket(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("Expected no error for missing socket but got %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("keep me"), 0644)
+	if err := removeStaleSocket(file); err == nil {
+		t.Errorf("Expected error removing a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected regular file to be kept but got %v", err)
+	}
+
+	socket := filepath.Join(dir, "stale.socket")
+	// unlike a listener, closing a datagram socket leaves its file behind
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Could not create socket: %v", err)
+	}
+	conn.Close()
+	if err := removeStaleSocket(socket); err != nil {
+		t.Errorf("Unexpected error removing stale socket: %v", err)
+	}
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected stale socket to be removed but got %v", err)
+	}
+}
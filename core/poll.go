@@ -11,7 +11,7 @@ func (a *App) poll(pollable Pollable) chan bool {
 		for {
 			select {
 			case <-ticker.C:
-				if !a.InMaintenanceMode() {
+				if !a.InMaintenanceMode() || isDraining(pollable) {
 					pollable.PollAction()
 				}
 			case <-quit:
@@ -23,9 +23,63 @@ func (a *App) poll(pollable Pollable) chan bool {
 	return quit
 }
 
+// Run the `WatchAction` function in a loop. The action is expected to
+// block until something changes, so the quit channel is buffered and the
+// watchable is stopped as soon as we quit, rather than when an in-flight
+// watch returns, so that it can cancel the watch and ignore its changes.
+func (a *App) watch(watchable Watchable) chan bool {
+	quit := make(chan bool, 1)
+	stopped := make(chan struct{})
+	go func() {
+		<-quit
+		watchable.PollStop()
+		close(stopped)
+	}()
+	go func() {
+		for {
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			if a.InMaintenanceMode() {
+				// we can't block on a watch while paused, so wait out
+				// a poll interval before checking again
+				select {
+				case <-time.After(watchable.PollTime()):
+				case <-stopped:
+					return
+				}
+				continue
+			}
+			watchable.WatchAction()
+		}
+	}()
+	return quit
+}
+
 // Pollable is base abstraction for backends and services that support polling
 type Pollable interface {
 	PollTime() time.Duration
 	PollAction()
 	PollStop()
 }
+
+// Drainable is a Pollable that keeps polling while it drains before
+// maintenance, even when the App is in maintenance mode
+type Drainable interface {
+	Pollable
+	Draining() bool
+}
+
+func isDraining(pollable Pollable) bool {
+	drainable, ok := pollable.(Drainable)
+	return ok && drainable.Draining()
+}
+
+// Watchable is a Pollable that can instead block waiting for changes
+type Watchable interface {
+	Pollable
+	Watching() bool
+	WatchAction()
+}
@@ -1,8 +1,13 @@
 package core
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
+
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/memory"
 )
 
 type DummyPollable struct{}
@@ -22,3 +27,120 @@ func TestPoll(t *testing.T) {
 	quit := app.poll(service)
 	close(quit)
 }
+
+type DummyWatchable struct {
+	DummyPollable
+	watches chan bool
+}
+
+func (w *DummyWatchable) Watching() bool { return true }
+func (w *DummyWatchable) WatchAction() {
+	w.watches <- true
+	time.Sleep(10 * time.Millisecond)
+}
+
+// Verify that we can stop a watch even while it's blocked in WatchAction
+func TestWatch(t *testing.T) {
+	app := EmptyApp()
+	watchable := &DummyWatchable{watches: make(chan bool, 10)}
+	quit := app.watch(watchable)
+	<-watchable.watches
+	select {
+	case quit <- true:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out stopping watch")
+	}
+}
+
+type DummyDrainable struct {
+	draining bool
+	polls    chan bool
+}
+
+func (d *DummyDrainable) PollTime() time.Duration { return 10 * time.Millisecond }
+func (d *DummyDrainable) PollAction()             { d.polls <- true }
+func (d *DummyDrainable) PollStop()               {}
+func (d *DummyDrainable) Draining() bool          { return d.draining }
+
+// Verify that a draining pollable keeps polling while the App is paused
+func TestPollDrainingInMaintenance(t *testing.T) {
+	app := EmptyApp()
+	app.paused = true
+	idle := &DummyDrainable{polls: make(chan bool, 10)}
+	draining := &DummyDrainable{draining: true, polls: make(chan bool, 10)}
+	quitIdle := app.poll(idle)
+	quitDraining := app.poll(draining)
+	defer close(quitIdle)
+	defer close(quitDraining)
+	select {
+	case <-draining.polls:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected draining pollable to be polled in maintenance")
+	}
+	select {
+	case <-idle.polls:
+		t.Errorf("Expected no polling in maintenance")
+	default:
+	}
+}
+
+// Verify that a change seen by the watch of a backend after a reload
+// doesn't fire the onChange of the old config
+func TestWatchReload(t *testing.T) {
+	tmpf, _ := ioutil.TempFile("", "gotest")
+	tmpf.Close()
+	defer os.Remove(tmpf.Name())
+	app, err := NewApp(`{
+    "memory": {},
+    "backends": [{"name": "upstream", "poll": 1, "watch": true, "maxWait": "5s",
+                  "onChange": ["sh", "-c", "echo changed >> ` + tmpf.Name() + `"]}]
+  }`)
+	if err != nil {
+		t.Fatalf("Got error while initializing config: %v", err)
+	}
+	backend := app.ServiceBackend.(*memory.Memory)
+	app.handlePolling()
+	defer app.stopPolling()
+	time.Sleep(50 * time.Millisecond) // let the watch block
+
+	if err := app.Reload(); err != nil {
+		t.Fatalf("Unexpected error reloading: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond) // let the old backend stop
+	backend.SetUpstreams("upstream", &discovery.ServiceDefinition{
+		ID: "upstream-1", Name: "upstream", IPAddress: "192.168.1.1", Port: 80})
+	time.Sleep(100 * time.Millisecond)
+	if out, _ := ioutil.ReadFile(tmpf.Name()); len(out) != 0 {
+		t.Errorf("Expected no onChange from the old config but got %q", out)
+	}
+}
+
+func TestReloadDuringDebounce(t *testing.T) {
+	tmpf, _ := ioutil.TempFile("", "gotest")
+	tmpf.Close()
+	defer os.Remove(tmpf.Name())
+	cfg := `{
+    "memory": {},
+    "backends": [{"name": "upstream", "poll": 1, "debounce": "200ms",
+                  "onChange": ["sh", "-c", "echo changed >> ` + tmpf.Name() + `"]}]
+  }`
+	app, err := NewApp(cfg)
+	if err != nil {
+		t.Fatalf("Got error while initializing config: %v", err)
+	}
+	app.handlePolling()
+	defer app.stopPolling()
+
+	app.Backends[0].Changed()
+	if err := app.Reload(); err != nil {
+		t.Fatalf("Unexpected error reloading: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if out, _ := ioutil.ReadFile(tmpf.Name()); len(out) != 0 {
+		t.Errorf("Expected no onChange during debounce but got %q", out)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if out, _ := ioutil.ReadFile(tmpf.Name()); string(out) != "changed\n" {
+		t.Errorf("Expected one onChange after the reload but got %q", out)
+	}
+}
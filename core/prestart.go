@@ -0,0 +1,121 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+)
+
+// how long we wait between attempts to take the preStart lock
+var preStartLockRetry = time.Second
+
+// runPreStart runs the preStart command, if any. With a preStartLock,
+// we wait to take the lock first, keep it while the command runs, and
+// release it as soon as the command exits.
+func (a *App) runPreStart() (int, error) {
+	if a.PreStartCmd == nil {
+		return 0, nil
+	}
+	fields := log.Fields{"process": "PreStart"}
+	if a.PreStartLock == nil {
+		return commands.RunAndWait(a.PreStartCmd, fields)
+	}
+	locker := a.ServiceBackend.(discovery.Locker)
+	holder, err := a.getLockHolder()
+	if err != nil {
+		log.Error(err)
+		return 1, err
+	}
+	lock := discovery.NewLock(fmt.Sprintf("preStart/%s", a.PreStartLock.Name),
+		holder, a.PreStartLock.TTL)
+	if err := a.waitForPreStartLock(locker, lock); err != nil {
+		log.Error(err)
+		return 1, err
+	}
+	log.Infof("preStart: took lock %s", a.PreStartLock.Name)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		keepLock(locker, lock, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+		if err := locker.Unlock(lock); err != nil {
+			log.Warnf("preStart: unable to release lock %s: %s",
+				a.PreStartLock.Name, err)
+			return
+		}
+		log.Infof("preStart: released lock %s", a.PreStartLock.Name)
+	}()
+	return commands.RunAndWait(a.PreStartCmd, fields)
+}
+
+// getLockHolder returns the holder of the locks this App takes, which is
+// generated on first use and then kept for the life of the App
+func (a *App) getLockHolder() (string, error) {
+	if a.lockHolder == "" {
+		holder, err := discovery.NewLockHolder()
+		if err != nil {
+			return "", err
+		}
+		a.lockHolder = holder
+	}
+	return a.lockHolder, nil
+}
+
+// waitForPreStartLock tries to take the lock until it's ours, the lock's
+// timeout elapses, or we're terminated
+func (a *App) waitForPreStartLock(locker discovery.Locker, lock *discovery.Lock) error {
+	var timeout <-chan time.Time
+	if a.PreStartLock.TimeoutDuration > 0 {
+		timer := time.NewTimer(a.PreStartLock.TimeoutDuration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		held, err := locker.TryLock(lock)
+		if err != nil {
+			log.Warnf("preStart: unable to take lock %s: %s", a.PreStartLock.Name, err)
+		}
+		if held {
+			return nil
+		}
+		log.Debugf("preStart: waiting for lock %s", a.PreStartLock.Name)
+		select {
+		case <-timeout:
+			return fmt.Errorf("Timed out waiting for preStart lock %s",
+				a.PreStartLock.Name)
+		case <-a.stopWaiting:
+			return fmt.Errorf("Terminated while waiting for preStart lock %s",
+				a.PreStartLock.Name)
+		case <-time.After(preStartLockRetry):
+		}
+	}
+}
+
+// keepLock refreshes the lock at half its TTL until stopped. If the lock
+// is lost there's nothing we can do about the running preStart, so we
+// only warn about it.
+func keepLock(locker discovery.Locker, lock *discovery.Lock, stop <-chan struct{}) {
+	interval := time.Duration(lock.TTL) * time.Second / 2
+	if interval < preStartLockRetry {
+		interval = preStartLockRetry
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if held, err := locker.TryLock(lock); !held {
+				log.Warnf("preStart: lost lock %s: %v", lock.Key, err)
+			}
+		}
+	}
+}
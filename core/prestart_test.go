@@ -0,0 +1,130 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/toming90/containerpilot/discovery"
+	_ "github.com/toming90/containerpilot/discovery/file"
+	"github.com/toming90/containerpilot/discovery/memory"
+)
+
+func TestPreStartLock(t *testing.T) {
+	tmpf, _ := ioutil.TempFile("", "gotest")
+	tmpf.Close()
+	defer os.Remove(tmpf.Name())
+	app, err := NewApp(`{
+    "memory": {},
+    "preStart": ["sh", "-c", "echo ran >> ` + tmpf.Name() + `"],
+    "preStartLock": {"name": "migrations", "ttl": 5, "timeout": "100ms"}
+  }`)
+	if err != nil {
+		t.Fatalf("Got error while initializing config: %v", err)
+	}
+	backend := app.ServiceBackend.(*memory.Memory)
+	other := discovery.NewLock("preStart/migrations", "other", 5)
+	backend.TryLock(other)
+
+	if _, err := app.runPreStart(); err == nil ||
+		err.Error() != "Timed out waiting for preStart lock migrations" {
+		t.Fatalf("Expected timeout waiting for lock but got %v", err)
+	}
+	if out, _ := ioutil.ReadFile(tmpf.Name()); len(out) != 0 {
+		t.Fatalf("Expected preStart not to run without the lock but got %q", out)
+	}
+
+	// the lock is released while we wait for it
+	preStartLockRetry = 10 * time.Millisecond
+	defer func() { preStartLockRetry = time.Second }()
+	app.PreStartLock.TimeoutDuration = time.Second
+	time.AfterFunc(50*time.Millisecond, func() { backend.Unlock(other) })
+	if _, err := app.runPreStart(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out, _ := ioutil.ReadFile(tmpf.Name()); string(out) != "ran\n" {
+		t.Errorf("Expected preStart to run once but got %q", out)
+	}
+	if holder := backend.LockHolder("preStart/migrations"); holder != "" {
+		t.Errorf("Expected lock to be released after preStart but held by %s", holder)
+	}
+
+	backend.TryLock(other)
+	app.PreStartLock.TimeoutDuration = 0
+	app.Terminate()
+	if _, err := app.runPreStart(); err == nil ||
+		err.Error() != "Terminated while waiting for preStart lock migrations" {
+		t.Errorf("Expected terminated error but got %v", err)
+	}
+}
+
+// two instances on the same host (such as with the host network) have
+// the same hostname, but mustn't both hold the lock
+func TestPreStartLockSameHostname(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gotest")
+	defer os.RemoveAll(dir)
+	backends := map[string]string{
+		"memory": `{}`,
+		"file":   `{"path": "` + dir + `/discovery"}`,
+	}
+	for name, backend := range backends {
+		marker := dir + "/" + name
+		first, err := NewApp(`{
+    "` + name + `": ` + backend + `,
+    "preStart": ["sh", "-c", "touch ` + marker + `; sleep 1"],
+    "preStartLock": {"name": "migrations", "ttl": 5}
+  }`)
+		if err != nil {
+			t.Fatalf("%s: got error while initializing config: %v", name, err)
+		}
+		second, err := NewApp(`{
+    "` + name + `": ` + backend + `,
+    "preStart": "/bin/true",
+    "preStartLock": {"name": "migrations", "ttl": 5, "timeout": "100ms"}
+  }`)
+		if err != nil {
+			t.Fatalf("%s: got error while initializing config: %v", name, err)
+		}
+		if name == "memory" {
+			second.ServiceBackend = first.ServiceBackend
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			first.runPreStart()
+		}()
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(marker); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := second.runPreStart(); err == nil ||
+			err.Error() != "Timed out waiting for preStart lock migrations" {
+			t.Errorf("%s: expected timeout waiting for lock but got %v", name, err)
+		}
+		<-done
+		if first.lockHolder == second.lockHolder {
+			t.Errorf("%s: expected unique lock holders but both are %s",
+				name, first.lockHolder)
+		}
+	}
+}
+
+func TestPreStartLockConfigError(t *testing.T) {
+	if _, err := NewApp(`{"memory": {}, "preStartLock": {"name": "migrations"}}`); err == nil ||
+		err.Error() != "`preStartLock` requires `preStart`" {
+		t.Errorf("Expected error for missing preStart but got %v", err)
+	}
+	if _, err := NewApp(`{"memory": {}, "preStart": "/bin/true",
+"preStartLock": {"ttl": 5}}`); err == nil ||
+		err.Error() != "`name` is required in `preStartLock`" {
+		t.Errorf("Expected error for missing name but got %v", err)
+	}
+	if _, err := NewApp(`{"memory": {}, "preStart": "/bin/true",
+"preStartLock": {"name": "migrations", "ttl": -1}}`); err == nil ||
+		err.Error() != "`ttl` must be > 0 in `preStartLock`" {
+		t.Errorf("Expected error for bad ttl but got %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package core
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
@@ -16,8 +19,7 @@ func (a *App) handleSignals() {
 		for signal := range sig {
 			switch signal {
 			case syscall.SIGUSR1:
-				log.Infof("Container is in maintenance because of: %v", signal)
-				a.ToggleMaintenanceMode()
+				a.handleMaintenanceSignal(signal)
 			case syscall.SIGTERM:
 				log.Infof("Container is terminated because of: %v", signal)
 				a.Terminate()
@@ -29,6 +31,58 @@ func (a *App) handleSignals() {
 	}()
 }
 
+// handleMaintenanceSignal toggles maintenance mode for the services
+// listed in the control `maintenanceFile`, one name per line, or for all
+// services if there's no such file. The file is removed once it's read,
+// so that the next signal without it applies to all services again.
+func (a *App) handleMaintenanceSignal(signal os.Signal) {
+	var names []string
+	if a.Control != nil && a.Control.MaintenanceFile != "" {
+		var err error
+		names, err = readMaintenanceFile(a.Control.MaintenanceFile)
+		if err != nil {
+			log.Errorf("Unable to read maintenance file: %v", err)
+			return
+		}
+	}
+	reason := fmt.Sprintf("Marked for maintenance by ContainerPilot on %v", signal)
+	if len(names) == 0 {
+		log.Infof("Container is in maintenance because of: %v", signal)
+		a.ToggleMaintenanceMode(reason)
+		return
+	}
+	for _, name := range names {
+		log.Infof("Toggling maintenance of service %s because of: %v", name, signal)
+		if err := a.ToggleServiceMaintenance(name, reason); err != nil {
+			log.Errorf("Unable to toggle maintenance: %v", err)
+		}
+	}
+}
+
+// readMaintenanceFile returns the service names in the file, skipping
+// blank lines and comments, and then removes it. A missing file has no
+// names.
+func readMaintenanceFile(path string) ([]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		log.Warnf("Unable to remove maintenance file %s: %v", path, err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
 // ReapChildren cleans up zombies
 // - on SIGCHLD send wait4() (ref http://linux.die.net/man/2/waitpid)
 func reapChildren() {
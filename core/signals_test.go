@@ -1,34 +1,31 @@
 package core
 
 import (
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/toming90/containerpilot/commands"
-	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/config"
 	"github.com/toming90/containerpilot/discovery/consul"
+	"github.com/toming90/containerpilot/discovery/memory"
 	"github.com/toming90/containerpilot/services"
 )
 
 // ------------------------------------------
 // Test setup with mock services
 
-// Mock Discovery
-type NoopServiceBackend struct{}
-
-func (c *NoopServiceBackend) SendHeartbeat(service *discovery.ServiceDefinition)      { return }
-func (c *NoopServiceBackend) CheckForUpstreamChanges(backend, tag string) bool        { return false }
-func (c *NoopServiceBackend) MarkForMaintenance(service *discovery.ServiceDefinition) {}
-func (c *NoopServiceBackend) Deregister(service *discovery.ServiceDefinition)         {}
-
 func getSignalTestConfig() *App {
+	backend := memory.NewMemory()
 	service, _ := services.NewService(
-		"test-service", 1, 1, 1, nil, nil, &NoopServiceBackend{})
+		"test-service", 1, 1, 1, nil, nil, backend)
 	app := EmptyApp()
+	app.ServiceBackend = backend
 	cmd, _ := commands.NewCommand([]string{
 		"./testdata/test.sh",
 		"interruptSleep"}, "0")
@@ -48,17 +45,56 @@ func TestMaintenanceSignal(t *testing.T) {
 		t.Fatal("Should not be in maintenance mode by default")
 	}
 
-	app.ToggleMaintenanceMode()
+	app.ToggleMaintenanceMode("")
 	if !app.InMaintenanceMode() {
 		t.Fatal("Should be in maintenance mode after receiving SIGUSR1")
 	}
+	backend := app.ServiceBackend.(*memory.Memory)
+	if backend.CallCount(memory.MarkForMaintenance, app.Services[0].ID) != 1 {
+		t.Fatalf("Expected service to be marked for maintenance: %v", backend.Calls())
+	}
 
-	app.ToggleMaintenanceMode()
+	app.ToggleMaintenanceMode("")
 	if app.InMaintenanceMode() {
 		t.Fatal("Should not be in maintenance mode after receiving second SIGUSR1")
 	}
 }
 
+// Test SIGUSR1 with services listed in the maintenance file
+func TestMaintenanceSignalServiceFile(t *testing.T) {
+	app := getSignalTestConfig()
+	other, _ := services.NewService(
+		"other-service", 1, 1, 1, nil, nil, app.ServiceBackend)
+	app.Services = append(app.Services, other)
+	dir, _ := ioutil.TempDir("", "containerpilot")
+	defer os.RemoveAll(dir)
+	app.Control = &config.ControlConfig{
+		MaintenanceFile: filepath.Join(dir, "maintenance")}
+
+	ioutil.WriteFile(app.Control.MaintenanceFile,
+		[]byte("# services to toggle\ntest-service\n\n"), 0644)
+	app.handleMaintenanceSignal(syscall.SIGUSR1)
+	if app.InMaintenanceMode() || !app.Services[0].InMaintenance() ||
+		other.InMaintenance() {
+		t.Fatal("Expected only test-service to be in maintenance")
+	}
+	if _, err := os.Stat(app.Control.MaintenanceFile); !os.IsNotExist(err) {
+		t.Errorf("Expected maintenance file to be removed but got %v", err)
+	}
+
+	ioutil.WriteFile(app.Control.MaintenanceFile, []byte("test-service"), 0644)
+	app.handleMaintenanceSignal(syscall.SIGUSR1)
+	if app.Services[0].InMaintenance() {
+		t.Fatal("Expected test-service to leave maintenance on second signal")
+	}
+
+	// without the file, the signal applies to every service
+	app.handleMaintenanceSignal(syscall.SIGUSR1)
+	if !app.InMaintenanceMode() {
+		t.Fatal("Expected all services to be in maintenance without the file")
+	}
+}
+
 // Test handler for SIGTERM. Note that the SIGCHLD handler is fired
 // by this same test, but that we don't have a separate unit test
 // because they'll interfere with each other's state.
@@ -1,10 +1,12 @@
 package consul
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"sort"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	consul "github.com/hashicorp/consul/api"
@@ -52,17 +54,54 @@ func NewConsulConfig(config interface{}) (*Consul, error) {
 
 func configFromMap(raw map[string]interface{}) (*consul.Config, error) {
 	config := &struct {
-		Address string `mapstructure:"address"`
-		Scheme  string `mapstructure:"scheme"`
-		Token   string `mapstructure:"token"`
+		Address            string `mapstructure:"address"`
+		Scheme             string `mapstructure:"scheme"`
+		Token              string `mapstructure:"token"`
+		TokenFile          string `mapstructure:"tokenFile"`
+		Datacenter         string `mapstructure:"datacenter"`
+		Namespace          string `mapstructure:"namespace"`
+		CAFile             string `mapstructure:"caFile"`
+		CertFile           string `mapstructure:"certFile"`
+		KeyFile            string `mapstructure:"keyFile"`
+		ServerName         string `mapstructure:"serverName"`
+		InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
 	}{}
 	if err := utils.DecodeRaw(raw, config); err != nil {
 		return nil, err
 	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("Consul `certFile` and `keyFile` must be used together")
+	}
+	if config.Token != "" && config.TokenFile != "" {
+		return nil, fmt.Errorf("Consul `token` and `tokenFile` are mutually exclusive")
+	}
+	// the token file is read each time the config is loaded, so a
+	// rotated token is picked up on SIGHUP
+	if config.TokenFile != "" {
+		token, err := ioutil.ReadFile(config.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read Consul `tokenFile`: %v", err)
+		}
+		config.Token = strings.TrimSpace(string(token))
+	}
+	useTLS := config.CAFile != "" || config.CertFile != "" ||
+		config.ServerName != "" || config.InsecureSkipVerify
+	if config.Scheme == "" && useTLS {
+		config.Scheme = "https"
+	}
 	return &consul.Config{
-		Address: config.Address,
-		Scheme:  config.Scheme,
-		Token:   config.Token,
+		Address:    config.Address,
+		Scheme:     config.Scheme,
+		Token:      config.Token,
+		Datacenter: config.Datacenter,
+		Namespace:  config.Namespace,
+		TLSConfig: consul.TLSConfig{
+			Address:            config.ServerName,
+			CAFile:             config.CAFile,
+			CertFile:           config.CertFile,
+			KeyFile:            config.KeyFile,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		},
 	}, nil
 }
 
@@ -95,23 +134,79 @@ func (c *Consul) GetClient() interface{} {
 	return c.Client
 }
 
+// defaultMaintenanceReason is the reason given to Consul when the caller
+// doesn't give one
+const defaultMaintenanceReason = "Marked for maintenance by ContainerPilot"
+
 // Deregister removes the node from Consul.
 func (c *Consul) Deregister(service *discovery.ServiceDefinition) {
-	c.MarkForMaintenance(service)
+	if err := c.Agent().ServiceDeregister(service.ID); err != nil {
+		log.Infof("Deregistering failed: %s", err)
+	}
 }
 
-// MarkForMaintenance removes the node from Consul.
+// MarkForMaintenance puts the service into Consul's maintenance mode with
+// the default reason
 func (c *Consul) MarkForMaintenance(service *discovery.ServiceDefinition) {
-	if err := c.Agent().ServiceDeregister(service.ID); err != nil {
-		log.Infof("Deregistering failed: %s", err)
+	if err := c.EnableMaintenance(service, ""); err != nil {
+		log.Infof("Marking for maintenance failed: %s", err)
 	}
 }
 
+// EnableMaintenance implements discovery.MaintenanceBackend. Unlike
+// deregistering, Consul's maintenance mode keeps the service in the
+// catalog, with a critical check that says why it's in maintenance.
+func (c *Consul) EnableMaintenance(service *discovery.ServiceDefinition, reason string) error {
+	if reason == "" {
+		reason = defaultMaintenanceReason
+	}
+	services, err := c.Agent().Services()
+	if err != nil {
+		return err
+	}
+	if _, ok := services[service.ID]; !ok {
+		// a service that hasn't been registered yet (ex. one that was
+		// in maintenance when ContainerPilot reloaded) is registered so
+		// that it's kept in the catalog like any other
+		if err := c.registerService(*service); err != nil {
+			return err
+		}
+		if err := c.registerCheck(*service); err != nil {
+			return err
+		}
+	}
+	return c.Agent().EnableServiceMaintenance(service.ID, reason)
+}
+
+// DisableMaintenance implements discovery.MaintenanceBackend
+func (c *Consul) DisableMaintenance(service *discovery.ServiceDefinition) error {
+	return c.Agent().DisableServiceMaintenance(service.ID)
+}
+
 // SendHeartbeat writes a TTL check status=ok to the consul store.
 // If consul has never seen this service, we register the service and
 // its TTL check.
 func (c *Consul) SendHeartbeat(service *discovery.ServiceDefinition) {
-	if err := c.Agent().PassTTL(service.ID, "ok"); err != nil {
+	c.sendTTL(service, discovery.StatusPassing, "ok")
+}
+
+// UpdateStatus writes a warning or critical TTL check status to the
+// consul store, with the output of the health check as its note. A
+// warning registers the service like a heartbeat would, but we don't
+// register a service for the first time just to mark it critical.
+func (c *Consul) UpdateStatus(service *discovery.ServiceDefinition,
+	status, output string) {
+	if status != discovery.StatusCritical {
+		c.sendTTL(service, status, output)
+		return
+	}
+	if err := updateTTL(c.Agent(), service.ID, status, output); err != nil {
+		log.Debugf("Unable to mark %s critical: %s", service.ID, err)
+	}
+}
+
+func (c *Consul) sendTTL(service *discovery.ServiceDefinition, status, output string) {
+	if err := updateTTL(c.Agent(), service.ID, status, output); err != nil {
 		log.Infof("%v\nService not registered, registering...", err)
 		if err = c.registerService(*service); err != nil {
 			log.Warnf("Service registration failed: %s", err)
@@ -123,78 +218,323 @@ func (c *Consul) SendHeartbeat(service *discovery.ServiceDefinition) {
 		}
 		// now that we're ensured we're registered, we can push the
 		// heartbeat again
-		if err := c.Agent().PassTTL(service.ID, "ok"); err != nil {
+		if err := updateTTL(c.Agent(), service.ID, status, output); err != nil {
 			log.Errorf("Failed to write heartbeat: %s", err)
 		}
 	}
 }
 
+// updateTTL writes the TTL check with the given status and note
+func updateTTL(agent *consul.Agent, checkID, status, note string) error {
+	switch status {
+	case discovery.StatusWarning:
+		return agent.WarnTTL(checkID, note)
+	case discovery.StatusCritical:
+		return agent.FailTTL(checkID, note)
+	default:
+		return agent.PassTTL(checkID, note)
+	}
+}
+
+// registerService registers the service along with its named checks. We
+// only register a service once all of its checks pass, so they start out
+// passing rather than critical.
 func (c *Consul) registerService(service discovery.ServiceDefinition) error {
+	var checks consul.AgentServiceChecks
+	for _, check := range service.Checks {
+		checks = append(checks, &consul.AgentServiceCheck{
+			CheckID: check.ID,
+			Name:    check.Name,
+			Notes:   namedCheckNotes(service, *check),
+			TTL:     fmt.Sprintf("%ds", check.TTL),
+			Status:  consul.HealthPassing,
+		})
+	}
 	return c.Agent().ServiceRegister(
 		&consul.AgentServiceRegistration{
-			ID:      service.ID,
-			Name:    service.Name,
-			Tags:    service.Tags,
-			Port:    service.Port,
-			Address: service.IPAddress,
+			ID:                service.ID,
+			Name:              service.Name,
+			Tags:              service.Tags,
+			Port:              service.Port,
+			Address:           service.IPAddress,
+			Meta:              service.Meta,
+			EnableTagOverride: service.EnableTagOverride,
+			Checks:            checks,
 		},
 	)
 }
 
 func (c *Consul) registerCheck(service discovery.ServiceDefinition) error {
+	name := service.CheckName
+	if name == "" {
+		name = service.ID
+	}
+	notes := service.CheckNotes
+	if notes == "" {
+		notes = fmt.Sprintf("TTL for %s set by containerpilot", service.Name)
+	}
 	return c.Agent().CheckRegister(
 		&consul.AgentCheckRegistration{
 			ID:        service.ID,
-			Name:      service.ID,
-			Notes:     fmt.Sprintf("TTL for %s set by containerpilot", service.Name),
+			Name:      name,
+			Notes:     notes,
+			ServiceID: service.ID,
+			AgentServiceCheck: consul.AgentServiceCheck{
+				TTL:                            fmt.Sprintf("%ds", service.TTL),
+				DeregisterCriticalServiceAfter: service.DeregisterCriticalServiceAfter,
+			},
+		},
+	)
+}
+
+// SendCheckHeartbeat writes a TTL check status=ok for one of the named
+// checks of a service. If consul has never seen this check but has the
+// service, we register the check against it first; a service that isn't
+// registered yet registers its checks along with it.
+func (c *Consul) SendCheckHeartbeat(service *discovery.ServiceDefinition,
+	check *discovery.CheckDefinition) {
+	c.sendCheckTTL(service, check, discovery.StatusPassing, "ok")
+}
+
+// UpdateCheckStatus writes a warning or critical TTL check status for one
+// of the named checks of a service, with the output of the check as its
+// note.
+func (c *Consul) UpdateCheckStatus(service *discovery.ServiceDefinition,
+	check *discovery.CheckDefinition, status, output string) {
+	if status != discovery.StatusCritical {
+		c.sendCheckTTL(service, check, status, output)
+		return
+	}
+	if err := updateTTL(c.Agent(), check.ID, status, output); err != nil {
+		log.Debugf("Unable to mark %s critical: %s", check.ID, err)
+	}
+}
+
+func (c *Consul) sendCheckTTL(service *discovery.ServiceDefinition,
+	check *discovery.CheckDefinition, status, output string) {
+	if err := updateTTL(c.Agent(), check.ID, status, output); err != nil {
+		services, err := c.Agent().Services()
+		if err != nil {
+			log.Warnf("Failed to write heartbeat for check %s: %s", check.ID, err)
+			return
+		}
+		if _, ok := services[service.ID]; !ok {
+			log.Debugf("Check %s waits for service %s to be registered",
+				check.ID, service.ID)
+			return
+		}
+		log.Infof("Check %s not registered, registering...", check.ID)
+		if err = c.registerNamedCheck(*service, *check); err != nil {
+			log.Warnf("Check registration failed: %s", err)
+			return
+		}
+		if err := updateTTL(c.Agent(), check.ID, status, output); err != nil {
+			log.Errorf("Failed to write heartbeat: %s", err)
+		}
+	}
+}
+
+func (c *Consul) registerNamedCheck(service discovery.ServiceDefinition,
+	check discovery.CheckDefinition) error {
+	return c.Agent().CheckRegister(
+		&consul.AgentCheckRegistration{
+			ID:        check.ID,
+			Name:      check.Name,
+			Notes:     namedCheckNotes(service, check),
 			ServiceID: service.ID,
 			AgentServiceCheck: consul.AgentServiceCheck{
-				TTL: fmt.Sprintf("%ds", service.TTL),
+				TTL: fmt.Sprintf("%ds", check.TTL),
 			},
 		},
 	)
 }
 
-var upstreams = make(map[string][]*consul.ServiceEntry)
+func namedCheckNotes(service discovery.ServiceDefinition, check discovery.CheckDefinition) string {
+	return fmt.Sprintf("TTL for %s check of %s set by containerpilot", check.Name, service.Name)
+}
+
+// LookupService implements discovery.ServiceLookup. Service IDs only have
+// to be unique on each agent, so we ask the local agent.
+func (c *Consul) LookupService(service *discovery.ServiceDefinition) (*discovery.ServiceInstance, error) {
+	services, err := c.Agent().Services()
+	if err != nil {
+		return nil, err
+	}
+	registered, ok := services[service.ID]
+	if !ok {
+		return nil, nil
+	}
+	status := discovery.StatusCritical
+	checks, err := c.Agent().Checks()
+	if err != nil {
+		return nil, err
+	}
+	if check, ok := checks[service.ID]; ok {
+		status = check.Status
+	}
+	return &discovery.ServiceInstance{
+		ID:      registered.ID,
+		Address: registered.Address,
+		Port:    registered.Port,
+		Tags:    registered.Tags,
+		Meta:    registered.Meta,
+		Status:  status,
+	}, nil
+}
+
+// NodeFilters implements discovery.NodeFilter; Consul supports them all
+func (c *Consul) NodeFilters() []string {
+	return []string{"datacenter", "nodeMeta", "near"}
+}
+
+// queryOptions returns the options for a health query of the upstream
+func queryOptions(upstream *discovery.Upstream) *consul.QueryOptions {
+	return &consul.QueryOptions{
+		Datacenter: upstream.Datacenter,
+		NodeMeta:   upstream.NodeMeta,
+		Near:       upstream.Near,
+	}
+}
 
 // CheckForUpstreamChanges runs the health check
-func (c Consul) CheckForUpstreamChanges(backendName, backendTag string) bool {
-	services, meta, err := c.Health().Service(backendName, backendTag, true, nil)
+func (c Consul) CheckForUpstreamChanges(upstream *discovery.Upstream) bool {
+	services, meta, err := c.Health().ServiceMultipleTags(upstream.Name,
+		upstream.Tags, false, queryOptions(upstream))
 	if err != nil {
-		log.Warnf("Failed to query %v: %s [%v]", backendName, err, meta)
+		log.Warnf("Failed to query %v: %s [%v]", upstream.Name, err, meta)
 		return false
 	}
-	didChange := compareForChange(upstreams[backendName], services)
-	if didChange || len(services) == 0 {
-		// We don't want to cause an onChange event the first time we read-in
-		// but we do want to make sure we've written the key for this map
-		upstreams[backendName] = services
-	}
-	return didChange
+	return upstream.Update(toInstances(services))
 }
 
-// Compare the two arrays to see if the address or port has changed
-// or if we've added or removed entries.
-func compareForChange(existing, new []*consul.ServiceEntry) (changed bool) {
+// WatchForUpstreamChanges makes a blocking query to Consul for the
+// backend, returning as soon as the healthy instances change or when
+// maxWait elapses without a change.
+func (c *Consul) WatchForUpstreamChanges(upstream *discovery.Upstream,
+	maxWait time.Duration) (bool, error) {
+	ctx := watchContext(upstream)
+	opts := queryOptions(upstream).WithContext(ctx)
+	opts.WaitIndex = upstream.Index
+	opts.WaitTime = maxWait
+	services, meta, err := c.Health().ServiceMultipleTags(upstream.Name,
+		upstream.Tags, false, opts)
+	if ctx.Err() != nil {
+		return false, nil // the upstream was closed during the query
+	}
+	if err != nil {
+		// start over with a non-blocking query on the next attempt
+		upstream.Index = 0
+		return false, err
+	}
+	// the index can go backwards (ex. after a Consul snapshot restore),
+	// in which case we need to reset it or we'll block on a stale index
+	if meta.LastIndex < upstream.Index {
+		upstream.Index = 0
+	} else {
+		upstream.Index = meta.LastIndex
+	}
+	return upstream.Update(toInstances(services)), nil
+}
 
-	if len(existing) != len(new) {
-		return true
+// watchContext returns the context for the blocking queries on an
+// upstream, which is cancelled when the upstream is closed
+func watchContext(upstream *discovery.Upstream) context.Context {
+	if ctx, ok := upstream.Watch.(context.Context); ok {
+		return ctx
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	upstream.Watch = ctx
+	upstream.OnClose(cancel)
+	return ctx
+}
 
-	sort.Sort(ByServiceID(existing))
-	sort.Sort(ByServiceID(new))
-	for i, ex := range existing {
-		if ex.Service.Address != new[i].Service.Address ||
-			ex.Service.Port != new[i].Service.Port {
-			return true
+// toInstances returns the entries that aren't critical as instances, with
+// the aggregate status of their checks. Instances registered without an
+// address use the address of their node.
+func toInstances(services []*consul.ServiceEntry) []discovery.ServiceInstance {
+	instances := []discovery.ServiceInstance{}
+	for _, entry := range services {
+		status := entry.Checks.AggregatedStatus()
+		if status != consul.HealthPassing && status != consul.HealthWarning {
+			continue
+		}
+		address := entry.Service.Address
+		if address == "" && entry.Node != nil {
+			address = entry.Node.Address
 		}
+		instances = append(instances, discovery.ServiceInstance{
+			ID:      entry.Service.ID,
+			Address: address,
+			Port:    entry.Service.Port,
+			Tags:    entry.Service.Tags,
+			Meta:    entry.Service.Meta,
+			Status:  status,
+		})
 	}
-	return false
+	return instances
 }
 
-// ByServiceID implements the Sort interface because Go can't sort without it.
-type ByServiceID []*consul.ServiceEntry
+// the shortest TTL that Consul allows for a session
+const minSessionTTL = 10
 
-func (se ByServiceID) Len() int           { return len(se) }
-func (se ByServiceID) Swap(i, j int)      { se[i], se[j] = se[j], se[i] }
-func (se ByServiceID) Less(i, j int) bool { return se[i].Service.ID < se[j].Service.ID }
+func lockKey(lock *discovery.Lock) string {
+	return fmt.Sprintf("containerpilot/%s/%s", discovery.LockPrefix, lock.Key)
+}
+
+// TryLock implements discovery.Locker by acquiring the lock's key with a
+// Consul session, which is renewed on each call. If the session has been
+// invalidated (ex. it expired) we start over with a new one. Sessions
+// can't have a TTL under 10s, so shorter lock TTLs are rounded up.
+func (c *Consul) TryLock(lock *discovery.Lock) (bool, error) {
+	session, _ := lock.Session.(string)
+	if session != "" {
+		entry, _, err := c.Session().Renew(session, nil)
+		if err != nil {
+			return false, err
+		}
+		if entry == nil {
+			session = ""
+		}
+	}
+	if session == "" {
+		ttl := lock.TTL
+		if ttl < minSessionTTL {
+			ttl = minSessionTTL
+		}
+		id, _, err := c.Session().Create(&consul.SessionEntry{
+			Name: lock.Key,
+			TTL:  fmt.Sprintf("%ds", ttl),
+		}, nil)
+		if err != nil {
+			lock.Session = nil
+			return false, err
+		}
+		session = id
+	}
+	lock.Session = session
+	acquired, _, err := c.KV().Acquire(&consul.KVPair{
+		Key:     lockKey(lock),
+		Value:   []byte(lock.Holder),
+		Session: session,
+	}, nil)
+	return acquired, err
+}
+
+// Unlock implements discovery.Locker by releasing the lock's key and
+// destroying the session. Releasing the key first means another instance
+// can take the lock without waiting out Consul's lock-delay.
+func (c *Consul) Unlock(lock *discovery.Lock) error {
+	session, ok := lock.Session.(string)
+	if !ok {
+		return nil
+	}
+	lock.Session = nil
+	if _, _, err := c.KV().Release(&consul.KVPair{
+		Key:     lockKey(lock),
+		Session: session,
+	}, nil); err != nil {
+		return err
+	}
+	_, err := c.Session().Destroy(session, nil)
+	return err
+}
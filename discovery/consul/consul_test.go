@@ -1,6 +1,11 @@
 package consul
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -31,6 +36,71 @@ func TestConsulObjectParse(t *testing.T) {
 	}
 }
 
+func TestConsulTLSParse(t *testing.T) {
+	cfg, err := configFromMap(map[string]interface{}{
+		"address":            "consul:8501",
+		"datacenter":         "dc2",
+		"namespace":          "team",
+		"caFile":             "/etc/consul/ca.pem",
+		"certFile":           "/etc/consul/client.pem",
+		"keyFile":            "/etc/consul/client-key.pem",
+		"serverName":         "consul.example.com",
+		"insecureSkipVerify": true,
+	})
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+	if cfg.Scheme != "https" || cfg.Datacenter != "dc2" || cfg.Namespace != "team" {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+	tls := cfg.TLSConfig
+	if tls.CAFile != "/etc/consul/ca.pem" || tls.CertFile != "/etc/consul/client.pem" ||
+		tls.KeyFile != "/etc/consul/client-key.pem" ||
+		tls.Address != "consul.example.com" || !tls.InsecureSkipVerify {
+		t.Errorf("Unexpected TLS config: %+v", tls)
+	}
+
+	_, err = configFromMap(map[string]interface{}{
+		"address": "consul:8501", "certFile": "/etc/consul/client.pem"})
+	expected := "Consul `certFile` and `keyFile` must be used together"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+	if _, err = NewConsulConfig(map[string]interface{}{
+		"address": "consul:8501", "caFile": "/does/not/exist"}); err == nil {
+		t.Errorf("Expected error for missing caFile but got nil")
+	}
+}
+
+func TestConsulTokenFileParse(t *testing.T) {
+	tokenFile, _ := ioutil.TempFile("", "consul-token")
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("ec492475-7753-4ff0-bd65-2f056d68f78b\n")
+	tokenFile.Close()
+
+	rawCfg := map[string]interface{}{"address": "consul:8500", "tokenFile": tokenFile.Name()}
+	cfg, err := configFromMap(rawCfg)
+	if err != nil || cfg.Token != "ec492475-7753-4ff0-bd65-2f056d68f78b" {
+		t.Fatalf("Expected token from file but got %q (%v)", cfg.Token, err)
+	}
+
+	// the file is re-read whenever the config is loaded
+	ioutil.WriteFile(tokenFile.Name(), []byte("rotated"), 0600)
+	if cfg, _ = configFromMap(rawCfg); cfg.Token != "rotated" {
+		t.Errorf("Expected rotated token but got %q", cfg.Token)
+	}
+
+	rawCfg["token"] = "inline"
+	expected := "Consul `token` and `tokenFile` are mutually exclusive"
+	if _, err = configFromMap(rawCfg); err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+	if _, err = configFromMap(map[string]interface{}{
+		"address": "consul:8500", "tokenFile": "/does/not/exist"}); err == nil {
+		t.Errorf("Expected error for missing tokenFile but got nil")
+	}
+}
+
 func TestConsulAddressParse(t *testing.T) {
 	// typical valid entries
 	runParseTest(t, "https://consul:8500", "consul:8500", "https")
@@ -55,6 +125,18 @@ func runParseTest(t *testing.T, uri, expectedAddress, expectedScheme string) {
 	}
 }
 
+func TestConsulQueryOptions(t *testing.T) {
+	upstream := discovery.NewUpstream("app", "web")
+	upstream.Datacenter = "dc2"
+	upstream.NodeMeta = map[string]string{"rack": "r1"}
+	upstream.Near = "_agent"
+	opts := queryOptions(upstream)
+	if opts.Datacenter != "dc2" || opts.Near != "_agent" ||
+		!reflect.DeepEqual(opts.NodeMeta, upstream.NodeMeta) {
+		t.Errorf("Expected query options from upstream but got %+v", opts)
+	}
+}
+
 func TestConsulTTLPass(t *testing.T) {
 	consul, service := setupConsul("service-TestConsulTTLPass")
 	id := service.ID
@@ -67,24 +149,158 @@ func TestConsulTTLPass(t *testing.T) {
 	}
 }
 
+func TestConsulRegistrationOptions(t *testing.T) {
+	consul, service := setupConsul("service-TestConsulRegistrationOptions")
+	service.Meta = map[string]string{"version": "1.2"}
+	service.EnableTagOverride = true
+	service.CheckName = "app"
+	service.CheckNotes = "heartbeat of app"
+	service.DeregisterCriticalServiceAfter = "1m0s"
+	consul.SendHeartbeat(service) // force registration
+
+	services, _ := consul.Agent().Services()
+	registered := services[service.ID]
+	if registered == nil || registered.Meta["version"] != "1.2" ||
+		!registered.EnableTagOverride {
+		t.Errorf("Expected registration options on service but got %+v", registered)
+	}
+	checks, _ := consul.Agent().Checks()
+	check := checks[service.ID]
+	if check == nil || check.Name != "app" || check.Notes != "heartbeat of app" {
+		t.Errorf("Expected check name and notes but got %+v", check)
+	}
+}
+
+func TestConsulMaintenance(t *testing.T) {
+	consul, service := setupConsul("service-TestConsulMaintenance")
+	consul.SendHeartbeat(service) // force registration
+	if err := consul.EnableMaintenance(service, "upgrading"); err != nil {
+		t.Fatalf("Unexpected error entering maintenance: %v", err)
+	}
+	services, _ := consul.Agent().Services()
+	if services[service.ID] == nil {
+		t.Fatalf("Expected %s to stay registered in maintenance", service.ID)
+	}
+	checks, _ := consul.Agent().Checks()
+	maint := checks["_service_maintenance:"+service.ID]
+	if maint == nil || maint.Status != "critical" || maint.Notes != "upgrading" {
+		t.Fatalf("Expected critical maintenance check with reason but got %+v", maint)
+	}
+	if err := consul.DisableMaintenance(service); err != nil {
+		t.Fatalf("Unexpected error exiting maintenance: %v", err)
+	}
+	checks, _ = consul.Agent().Checks()
+	if checks["_service_maintenance:"+service.ID] != nil {
+		t.Errorf("Expected maintenance check to be removed")
+	}
+	consul.Deregister(service)
+}
+
 func TestConsulCheckForChanges(t *testing.T) {
 	backend := "service-TestConsulCheckForChanges"
 	consul, service := setupConsul(backend)
 	id := service.ID
-	if consul.CheckForUpstreamChanges(backend, "") {
+	upstream := discovery.NewUpstream(backend, "")
+	if consul.CheckForUpstreamChanges(upstream) {
 		t.Fatalf("First read of %s should show `false` for change", id)
 	}
 	consul.SendHeartbeat(service) // force registration
 	consul.SendHeartbeat(service) // write TTL
 
-	if !consul.CheckForUpstreamChanges(backend, "") {
+	if !consul.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after first health check TTL", id)
+	}
+	if consul.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should not have changed without TTL expiring", id)
+	}
+	time.Sleep(2 * time.Second) // wait for TTL to expire
+	if !consul.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after TTL expired.", id)
+	}
+}
+
+func TestConsulWatchForChanges(t *testing.T) {
+	backend := "service-TestConsulWatchForChanges"
+	consul, service := setupConsul(backend)
+	id := service.ID
+	upstream := discovery.NewUpstream(backend, "")
+	if changed, err := consul.WatchForUpstreamChanges(upstream, time.Second); err != nil || changed {
+		t.Fatalf("First read of %s should show `false` for change: %v", id, err)
+	}
+	consul.SendHeartbeat(service) // force registration
+	consul.SendHeartbeat(service) // write TTL
+
+	if changed, _ := consul.WatchForUpstreamChanges(upstream, time.Second); !changed {
 		t.Errorf("%v should have changed after first health check TTL", id)
 	}
-	if consul.CheckForUpstreamChanges(backend, "") {
+	start := time.Now()
+	if changed, _ := consul.WatchForUpstreamChanges(upstream, time.Second); changed {
 		t.Errorf("%v should not have changed without TTL expiring", id)
 	}
+	if time.Since(start) < 500*time.Millisecond {
+		t.Errorf("Expected watch of %v to block until maxWait", id)
+	}
 	time.Sleep(2 * time.Second) // wait for TTL to expire
-	if !consul.CheckForUpstreamChanges(backend, "") {
+	if changed, _ := consul.WatchForUpstreamChanges(upstream, time.Second); !changed {
 		t.Errorf("%v should have changed after TTL expired.", id)
 	}
 }
+
+func TestConsulWatchCancelledOnClose(t *testing.T) {
+	// a Consul that holds blocking queries open until they're cancelled
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+	defer server.Close()
+	consul, _ := NewConsulConfig(server.URL)
+	upstream := discovery.NewUpstream("app", "")
+
+	done := make(chan bool)
+	go func() {
+		changed, err := consul.WatchForUpstreamChanges(upstream, time.Minute)
+		done <- changed || err != nil
+	}()
+	time.Sleep(50 * time.Millisecond)
+	upstream.Close()
+	select {
+	case failed := <-done:
+		if failed {
+			t.Errorf("Expected a cancelled watch to report no change and no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected watch to return once the upstream was closed")
+	}
+}
+
+func TestConsulCheckTTLPass(t *testing.T) {
+	consul, service := setupConsul("service-TestConsulCheckTTLPass")
+	check := &discovery.CheckDefinition{
+		ID:   service.ID + ":db",
+		Name: "db",
+		TTL:  1,
+	}
+	service.Checks = []*discovery.CheckDefinition{check}
+
+	// the check waits for the service to be registered
+	consul.SendCheckHeartbeat(service, check)
+	checks, _ := consul.Agent().Checks()
+	if _, ok := checks[check.ID]; ok {
+		t.Fatalf("check %s should not be registered before service %s", check.ID, service.ID)
+	}
+
+	// and is registered along with it
+	consul.SendHeartbeat(service)
+	checks, _ = consul.Agent().Checks()
+	if status := checks[check.ID]; status == nil || status.Status != "passing" {
+		t.Fatalf("status of check %s should be 'passing' but is %v", check.ID, status)
+	}
+	consul.SendCheckHeartbeat(service, check)
+	checks, _ = consul.Agent().Checks()
+	if status := checks[check.ID]; status == nil || status.Status != "passing" {
+		t.Fatalf("status of check %s should be 'passing' but is %v", check.ID, status)
+	}
+	if checks[check.ID].ServiceID != service.ID {
+		t.Fatalf("check %s should belong to service %s", check.ID, service.ID)
+	}
+}
@@ -1,19 +1,157 @@
 package discovery
 
-import log "github.com/Sirupsen/logrus"
+import (
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
 
 // ServiceBackend is an interface
 // which all service discovery backends must implement
 type ServiceBackend interface {
 	SendHeartbeat(service *ServiceDefinition)
-	CheckForUpstreamChanges(backendName string, backendTag string) bool
+	UpdateStatus(service *ServiceDefinition, status string, output string)
+	CheckForUpstreamChanges(upstream *Upstream) bool
 	MarkForMaintenance(service *ServiceDefinition)
 	Deregister(service *ServiceDefinition)
 	GetClient() interface{}
 }
 
+// UpstreamWatcher is an optional interface for service discovery
+// backends that can block until an upstream changes (ex. Consul blocking
+// queries) rather than being polled for changes.
+type UpstreamWatcher interface {
+	WatchForUpstreamChanges(upstream *Upstream,
+		maxWait time.Duration) (bool, error)
+}
+
+// NodeFilter is an optional interface for service discovery backends that
+// know the node of each instance, and so can filter upstreams by their
+// node's datacenter or metadata, or sort them by distance from a node.
+// It returns which of the `datacenter`, `nodeMeta` and `near` options of
+// a backend are supported.
+type NodeFilter interface {
+	NodeFilters() []string
+}
+
+// CheckBackend is an optional interface for service discovery backends
+// that can report each of a service's named health checks separately.
+// Backends without it only see the aggregate status via SendHeartbeat.
+type CheckBackend interface {
+	SendCheckHeartbeat(service *ServiceDefinition, check *CheckDefinition)
+	UpdateCheckStatus(service *ServiceDefinition, check *CheckDefinition,
+		status string, output string)
+}
+
+// MaintenanceBackend is an optional interface for service discovery
+// backends with their own maintenance mode, which keeps the service
+// registered but out of rotation, along with the reason for operators.
+// Backends without it have MarkForMaintenance called instead, and are
+// registered again by the next heartbeat after maintenance.
+type MaintenanceBackend interface {
+	EnableMaintenance(service *ServiceDefinition, reason string) error
+	DisableMaintenance(service *ServiceDefinition) error
+}
+
+// ServiceLookup is an optional interface for service discovery backends
+// that can look up the current registration of a service's ID, so that
+// we can tell at startup whether another instance already uses it.
+// LookupService returns nil if the ID isn't registered.
+type ServiceLookup interface {
+	LookupService(service *ServiceDefinition) (*ServiceInstance, error)
+}
+
+// Closer is an optional interface for service discovery backends that
+// hold connections or goroutines of their own (ex. an etcd3 client), so
+// that they can be released when a reload replaces the backend.
+type Closer interface {
+	Close() error
+}
+
+// ServiceInstance is a passing or warning instance of an upstream service
+type ServiceInstance struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Status  string            `json:"status"`
+}
+
+// What CompareForChange compares between instances with the same ID. The
+// address and port are always compared.
+const (
+	ChangeOnAddress = "address"
+	ChangeOnTags    = "tags"
+	ChangeOnMeta    = "meta"
+	ChangeOnStatus  = "status"
+)
+
+// CompareForChange returns true if instances have been added or removed,
+// or if any of the changeOn fields of an instance has changed. Unless
+// the status is compared, only passing instances are considered.
+func CompareForChange(existing, new []ServiceInstance, changeOn []string) bool {
+	var tags, meta, status bool
+	for _, on := range changeOn {
+		switch on {
+		case ChangeOnTags:
+			tags = true
+		case ChangeOnMeta:
+			meta = true
+		case ChangeOnStatus:
+			status = true
+		}
+	}
+	if !status {
+		existing = PassingInstances(existing)
+		new = PassingInstances(new)
+	}
+	if len(existing) != len(new) {
+		return true
+	}
+	byID := make(map[string]ServiceInstance, len(existing))
+	for _, ex := range existing {
+		byID[ex.ID] = ex
+	}
+	for _, n := range new {
+		ex, ok := byID[n.ID]
+		if !ok || ex.Address != n.Address || ex.Port != n.Port {
+			return true
+		}
+		if (tags && !reflect.DeepEqual(ex.Tags, n.Tags)) ||
+			(meta && !reflect.DeepEqual(ex.Meta, n.Meta)) ||
+			(status && ex.Status != n.Status) {
+			return true
+		}
+	}
+	return false
+}
+
+// PassingInstances returns only the passing instances
+func PassingInstances(instances []ServiceInstance) []ServiceInstance {
+	passing := []ServiceInstance{}
+	for _, instance := range instances {
+		if instance.Status == StatusPassing {
+			passing = append(passing, instance)
+		}
+	}
+	return passing
+}
+
+// Health check statuses reported to the discovery backend. By convention
+// a health check command that exits with its service's `warningExitCode`
+// reports a warning; any other failure is critical.
+const (
+	StatusPassing  = "passing"
+	StatusWarning  = "warning"
+	StatusCritical = "critical"
+)
+
 // ServiceDefinition is the concrete service structure that is
-// registered with the service discovery backend.
+// registered with the service discovery backend. Backends that don't
+// support an option, such as EnableTagOverride outside of Consul, only
+// record it with the service.
 type ServiceDefinition struct {
 	ID        string
 	Name      string
@@ -21,6 +159,27 @@ type ServiceDefinition struct {
 	TTL       int
 	Tags      []string
 	IPAddress string
+	Meta      map[string]string
+
+	EnableTagOverride              bool
+	DeregisterCriticalServiceAfter string
+
+	// the name and notes of the service's TTL check; if empty, the
+	// service ID and a note of our own are used
+	CheckName  string
+	CheckNotes string
+
+	// the named checks of the service, which are registered along with
+	// the service so that they exist as soon as it does
+	Checks []*CheckDefinition
+}
+
+// CheckDefinition is a named health check of a service, which is
+// registered with the discovery backend alongside the service's TTL
+type CheckDefinition struct {
+	ID   string
+	Name string
+	TTL  int
 }
 
 // ServiceDiscoveryConfigHook parses a raw service discovery config
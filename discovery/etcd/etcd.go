@@ -3,7 +3,9 @@ package etcd
 import (
 	"encoding/json"
 	"fmt"
-	"sort"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,44 +20,121 @@ func init() {
 	discovery.RegisterBackend("etcd", ConfigHook)
 }
 
+// the dial timeout of the etcd client's default transport
+const defaultDialTimeout = 30 * time.Second
+
 // Etcd is a service discovery backend for CoreOS etcd
 type Etcd struct {
 	Client client.Client
 	API    client.KeysAPI
 	Prefix string
+
+	// last status written for each service ID, so that a heartbeat
+	// after a failure knows to rewrite the service record
+	statuses   map[string]string
+	statusLock sync.Mutex
 }
 
 // ServiceNode is the serializable form of an Etcd service record
 type ServiceNode struct {
-	ID      string   `json:"id"`
-	Name    string   `json:"name"`
-	Address string   `json:"address"`
-	Port    int      `json:"port"`
-	Tags    []string `json:"tags"`
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Status  string            `json:"status,omitempty"`
+	Output  string            `json:"output,omitempty"`
+
+	// options of the registration that etcd doesn't act on itself, but
+	// which are recorded for consumers of the service record
+	EnableTagOverride              bool   `json:"enableTagOverride,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"deregisterCriticalServiceAfter,omitempty"`
+	CheckName                      string `json:"checkName,omitempty"`
+	CheckNotes                     string `json:"checkNotes,omitempty"`
+}
+
+// NewServiceNode creates the service record for a service definition,
+// with its status if it isn't passing
+func NewServiceNode(service *discovery.ServiceDefinition, status, output string) ServiceNode {
+	node := ServiceNode{
+		ID:                             service.ID,
+		Name:                           service.Name,
+		Address:                        service.IPAddress,
+		Port:                           service.Port,
+		Tags:                           service.Tags,
+		Meta:                           service.Meta,
+		EnableTagOverride:              service.EnableTagOverride,
+		DeregisterCriticalServiceAfter: service.DeregisterCriticalServiceAfter,
+		CheckName:                      service.CheckName,
+		CheckNotes:                     service.CheckNotes,
+	}
+	if status != discovery.StatusPassing {
+		node.Status = status
+		node.Output = output
+	}
+	return node
+}
+
+// Instance returns the service record as a discovery.ServiceInstance.
+// Records written before statuses were recorded are passing.
+func (n ServiceNode) Instance() discovery.ServiceInstance {
+	status := n.Status
+	if status == "" {
+		status = discovery.StatusPassing
+	}
+	return discovery.ServiceInstance{
+		ID:      n.ID,
+		Address: n.Address,
+		Port:    n.Port,
+		Tags:    n.Tags,
+		Meta:    n.Meta,
+		Status:  status,
+	}
+}
+
+// FilterByTags returns the service records with all of the upstream's
+// tags as discovery.ServiceInstances
+func FilterByTags(nodes []ServiceNode, upstream *discovery.Upstream) []discovery.ServiceInstance {
+	instances := []discovery.ServiceInstance{}
+	for _, node := range nodes {
+		if upstream.HasTags(node.Tags) {
+			instances = append(instances, node.Instance())
+		}
+	}
+	return instances
 }
 
 type etcdRawConfig struct {
-	Endpoints interface{} `mapstructure:"endpoints"`
-	Prefix    string      `mapstructure:"prefix"`
+	Endpoints     interface{} `mapstructure:"endpoints"`
+	Prefix        string      `mapstructure:"prefix"`
+	CAFile        string      `mapstructure:"caFile"`
+	CertFile      string      `mapstructure:"certFile"`
+	KeyFile       string      `mapstructure:"keyFile"`
+	Username      string      `mapstructure:"username"`
+	Password      string      `mapstructure:"password"`
+	DialTimeout   interface{} `mapstructure:"dialTimeout"`
+	HeaderTimeout interface{} `mapstructure:"headerTimeout"`
 }
 
-func parseEndpoints(endpoints interface{}) []string {
+func parseEndpoints(endpoints interface{}) ([]string, error) {
+	var result []string
 	switch e := endpoints.(type) {
 	case string:
-		return []string{e}
+		result = []string{e}
 	case []string:
-		return e
+		result = e
 	case []interface{}:
-		var result []string
 		for _, i := range e {
 			if str, ok := i.(string); ok {
 				result = append(result, str)
 			}
 		}
-		return result
 	}
-	log.Fatal("Must provide etcd endpoints")
-	return nil
+	if len(result) == 0 {
+		return nil, fmt.Errorf("Must provide etcd endpoints")
+	}
+	return result, nil
 }
 
 // ConfigHook is the hook to register with the Etcd backend
@@ -66,14 +145,17 @@ func ConfigHook(raw interface{}) (discovery.ServiceBackend, error) {
 // NewEtcdConfig creates a new service discovery backend for etcd
 func NewEtcdConfig(raw interface{}) (*Etcd, error) {
 	etcd := &Etcd{
-		Prefix: "/containerpilot",
+		Prefix:   "/containerpilot",
+		statuses: make(map[string]string),
 	}
 	var config etcdRawConfig
-	etcdConfig := client.Config{}
 	if err := utils.DecodeRaw(raw, &config); err != nil {
 		return nil, err
 	}
-	etcdConfig.Endpoints = parseEndpoints(config.Endpoints)
+	etcdConfig, err := clientConfig(config)
+	if err != nil {
+		return nil, err
+	}
 	if config.Prefix != "" {
 		etcd.Prefix = config.Prefix
 	}
@@ -87,6 +169,54 @@ func NewEtcdConfig(raw interface{}) (*Etcd, error) {
 	return etcd, nil
 }
 
+// clientConfig creates the etcd client config, with its own transport if
+// we need TLS or a dial timeout
+func clientConfig(config etcdRawConfig) (client.Config, error) {
+	etcdConfig := client.Config{
+		Username: config.Username,
+		Password: config.Password,
+	}
+	endpoints, err := parseEndpoints(config.Endpoints)
+	if err != nil {
+		return etcdConfig, err
+	}
+	etcdConfig.Endpoints = endpoints
+	if config.Password != "" && config.Username == "" {
+		return etcdConfig, fmt.Errorf("etcd `password` requires a `username`")
+	}
+	if config.HeaderTimeout != nil {
+		timeout, err := utils.ParseDuration(config.HeaderTimeout)
+		if err != nil {
+			return etcdConfig, fmt.Errorf("Could not parse etcd `headerTimeout`: %v", err)
+		}
+		etcdConfig.HeaderTimeoutPerRequest = timeout
+	}
+	useTLS := config.CAFile != "" || config.CertFile != "" || config.KeyFile != ""
+	if !useTLS && config.DialTimeout == nil {
+		return etcdConfig, nil // use the client's default transport
+	}
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: 30 * time.Second}
+	if config.DialTimeout != nil {
+		if dialer.Timeout, err = utils.ParseDuration(config.DialTimeout); err != nil {
+			return etcdConfig, fmt.Errorf("Could not parse etcd `dialTimeout`: %v", err)
+		}
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dialer.Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if useTLS {
+		tlsConfig, err := utils.NewTLSConfig(config.CAFile, config.CertFile, config.KeyFile)
+		if err != nil {
+			return etcdConfig, fmt.Errorf("etcd TLS configuration error: %v", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	etcdConfig.Transport = transport
+	return etcdConfig, nil
+}
+
 // GetClient returns etcd client
 func (c *Etcd) GetClient() interface{} {
 	return c.Client
@@ -104,6 +234,28 @@ func (c *Etcd) MarkForMaintenance(service *discovery.ServiceDefinition) {
 
 // SendHeartbeat refreshes the TTL of this associated etcd node
 func (c *Etcd) SendHeartbeat(service *discovery.ServiceDefinition) {
+	c.sendTTL(service, discovery.StatusPassing, "")
+}
+
+// UpdateStatus writes a warning or critical status, along with the output
+// of the health check, to the service record. A critical service keeps
+// its record until the TTL expires but is no longer returned to upstream
+// consumers.
+func (c *Etcd) UpdateStatus(service *discovery.ServiceDefinition,
+	status, output string) {
+	if status != discovery.StatusCritical {
+		c.sendTTL(service, status, output)
+		return
+	}
+	if err := c.updateServiceStatus(service, status, output,
+		client.PrevExist); err != nil {
+		log.Debugf("Unable to mark %s critical: %s", service.ID, err)
+		return
+	}
+	c.setLastStatus(service.ID, status)
+}
+
+func (c *Etcd) sendTTL(service *discovery.ServiceDefinition, status, output string) {
 	if err := c.updateServiceTTL(service); err != nil {
 		log.Infof("Service not registered, registering...")
 		if err := c.registerService(service); err != nil {
@@ -114,8 +266,34 @@ func (c *Etcd) SendHeartbeat(service *discovery.ServiceDefinition) {
 		// heartbeat again
 		if err := c.updateServiceTTL(service); err != nil {
 			log.Errorf("Failed to write heartbeat: %s", err)
+			return
 		}
 	}
+	if status == discovery.StatusPassing && c.lastStatus(service.ID) == "" {
+		return
+	}
+	if err := c.updateServiceStatus(service, status, output,
+		client.PrevIgnore); err != nil {
+		log.Errorf("Failed to write status: %s", err)
+		return
+	}
+	c.setLastStatus(service.ID, status)
+}
+
+func (c *Etcd) lastStatus(serviceID string) string {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	return c.statuses[serviceID]
+}
+
+func (c *Etcd) setLastStatus(serviceID, status string) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	if status == discovery.StatusPassing {
+		delete(c.statuses, serviceID)
+	} else {
+		c.statuses[serviceID] = status
+	}
 }
 
 func (c *Etcd) getNodeKey(service *discovery.ServiceDefinition) string {
@@ -126,25 +304,17 @@ func (c *Etcd) getAppKey(appName string) string {
 	return fmt.Sprintf("%s/%s", c.Prefix, appName)
 }
 
-var etcdUpstreams = make(map[string][]ServiceNode)
-
 // CheckForUpstreamChanges checks another etcd node for changes
-func (c *Etcd) CheckForUpstreamChanges(backendName, backendTag string) bool {
-	// TODO: is there a way to filter by tag in etcd?
-	services, err := c.getServices(backendName)
+func (c *Etcd) CheckForUpstreamChanges(upstream *discovery.Upstream) bool {
+	services, err := c.getServices(upstream.Name)
 	if err != nil {
 		if _, ok := err.(client.Error); !ok {
-			log.Warnf("Failed to query %v: %s", backendName, err)
+			log.Warnf("Failed to query %v: %s", upstream.Name, err)
 		}
 		return false
 	}
-	didChange := etcdCompareForChange(etcdUpstreams[backendName], services)
-	if didChange || len(services) == 0 {
-		// We don't want to cause an onChange event the first time we read-in
-		// but we do want to make sure we've written the key for this map
-		etcdUpstreams[backendName] = services
-	}
-	return didChange
+	// etcd can't filter by tag, so we do it here
+	return upstream.Update(FilterByTags(services, upstream))
 }
 
 func (c *Etcd) getServices(appName string) ([]ServiceNode, error) {
@@ -170,9 +340,13 @@ func (c *Etcd) getServices(appName string) ([]ServiceNode, error) {
 			continue
 		}
 		for _, node := range instance.Nodes {
-			if service, err := decodeEtcdNodeValue(node); err != nil {
+			service, err := decodeEtcdNodeValue(node)
+			if err != nil {
 				log.Warnf("Could not decode etcd service %s: %s", node.Value, err)
-			} else {
+				continue
+			}
+			// critical instances are never upstreams, as with consul
+			if service.Status != discovery.StatusCritical {
 				services = append(services, service)
 			}
 		}
@@ -180,28 +354,10 @@ func (c *Etcd) getServices(appName string) ([]ServiceNode, error) {
 	return services, nil
 }
 
-// Compare the two arrays to see if the address or port has changed
-// or if we've added or removed entries.
-func etcdCompareForChange(existing, new []ServiceNode) (changed bool) {
-	if len(existing) != len(new) {
-		return true
-	}
-
-	sort.Sort(ByEtcdServiceID(existing))
-	sort.Sort(ByEtcdServiceID(new))
-	for i, ex := range existing {
-		if ex.Address != new[i].Address ||
-			ex.Port != new[i].Port {
-			return true
-		}
-	}
-	return false
-}
-
-func (c Etcd) registerService(service *discovery.ServiceDefinition) error {
+func (c *Etcd) registerService(service *discovery.ServiceDefinition) error {
 	key := c.getNodeKey(service)
 	serviceKey := fmt.Sprintf("%s/%s", key, "/service")
-	value := encodeEtcdNodeValue(service)
+	value := encodeEtcdNodeValue(service, "", "")
 	ttl, _ := time.ParseDuration(fmt.Sprintf("%ds", service.TTL))
 	// If the directory already exists, then this should silently fail (no error)
 	if _, err := c.API.Set(context.Background(), key, "",
@@ -215,7 +371,7 @@ func (c Etcd) registerService(service *discovery.ServiceDefinition) error {
 	return err
 }
 
-func (c Etcd) updateServiceTTL(service *discovery.ServiceDefinition) error {
+func (c *Etcd) updateServiceTTL(service *discovery.ServiceDefinition) error {
 	key := c.getNodeKey(service)
 	ttl, _ := time.ParseDuration(fmt.Sprintf("%ds", service.TTL))
 	_, err := c.API.Set(context.Background(), key, "",
@@ -223,19 +379,24 @@ func (c Etcd) updateServiceTTL(service *discovery.ServiceDefinition) error {
 	return err
 }
 
-func (c Etcd) deregisterService(service *discovery.ServiceDefinition) error {
+// updateServiceStatus overwrites the service record with the given status
+func (c *Etcd) updateServiceStatus(service *discovery.ServiceDefinition,
+	status, output string, prevExist client.PrevExistType) error {
+	serviceKey := fmt.Sprintf("%s/%s", c.getNodeKey(service), "/service")
+	value := encodeEtcdNodeValue(service, status, output)
+	_, err := c.API.Set(context.Background(), serviceKey, value,
+		&client.SetOptions{PrevExist: prevExist})
+	return err
+}
+
+func (c *Etcd) deregisterService(service *discovery.ServiceDefinition) error {
 	_, err := c.API.Delete(context.Background(), c.getNodeKey(service),
 		&client.DeleteOptions{Dir: true, Recursive: true})
 	return err
 }
 
-func encodeEtcdNodeValue(service *discovery.ServiceDefinition) string {
-	node := &ServiceNode{
-		ID:      service.ID,
-		Name:    service.Name,
-		Address: service.IPAddress,
-		Port:    service.Port,
-	}
+func encodeEtcdNodeValue(service *discovery.ServiceDefinition, status, output string) string {
+	node := NewServiceNode(service, status, output)
 	json, err := json.Marshal(&node)
 	if err != nil {
 		log.Warnf("Unable to encode service: %s", err)
@@ -253,6 +414,72 @@ func decodeEtcdNodeValue(node *client.Node) (ServiceNode, error) {
 	return service, nil
 }
 
+// LookupService implements discovery.ServiceLookup. The record expires
+// with the TTL of its directory, so only live registrations are found.
+func (c *Etcd) LookupService(service *discovery.ServiceDefinition) (*discovery.ServiceInstance, error) {
+	serviceKey := fmt.Sprintf("%s/%s", c.getNodeKey(service), "/service")
+	resp, err := c.API.Get(context.Background(), serviceKey, nil)
+	if err != nil {
+		if isEtcdError(err, client.ErrorCodeKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	node, err := decodeEtcdNodeValue(resp.Node)
+	if err != nil {
+		return nil, err
+	}
+	instance := node.Instance()
+	return &instance, nil
+}
+
+func (c *Etcd) getLockKey(lock *discovery.Lock) string {
+	return fmt.Sprintf("%s/%s/%s", c.Prefix, discovery.LockPrefix, lock.Key)
+}
+
+// TryLock implements discovery.Locker with a key that expires after the
+// lock's TTL. We create the key if it doesn't exist, or refresh its TTL
+// if we're the holder written in it; if someone else holds the lock
+// neither write succeeds.
+func (c *Etcd) TryLock(lock *discovery.Lock) (bool, error) {
+	key := c.getLockKey(lock)
+	ttl := time.Duration(lock.TTL) * time.Second
+	_, err := c.API.Set(context.Background(), key, lock.Holder,
+		&client.SetOptions{TTL: ttl, PrevExist: client.PrevNoExist})
+	if isEtcdError(err, client.ErrorCodeNodeExist) {
+		_, err = c.API.Set(context.Background(), key, lock.Holder,
+			&client.SetOptions{TTL: ttl, PrevValue: lock.Holder,
+				PrevExist: client.PrevExist})
+		// the lock is someone else's, or it expired since we tried to
+		// create it, in which case we'll try again on the next call
+		if isEtcdError(err, client.ErrorCodeTestFailed) ||
+			isEtcdError(err, client.ErrorCodeKeyNotFound) {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Unlock implements discovery.Locker by deleting the lock's key, but
+// only if we're the holder written in it
+func (c *Etcd) Unlock(lock *discovery.Lock) error {
+	_, err := c.API.Delete(context.Background(), c.getLockKey(lock),
+		&client.DeleteOptions{PrevValue: lock.Holder})
+	if isEtcdError(err, client.ErrorCodeTestFailed) ||
+		isEtcdError(err, client.ErrorCodeKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+func isEtcdError(err error, code int) bool {
+	etcdErr, ok := err.(client.Error)
+	return ok && etcdErr.Code == code
+}
+
 // ByEtcdServiceID implements the Sort interface because Go can't sort without it.
 type ByEtcdServiceID []ServiceNode
 
@@ -40,6 +40,105 @@ func TestEtcdParseStringEndpoints(t *testing.T) {
 	}
 }
 
+func TestEtcdParseOptions(t *testing.T) {
+	cfg, err := clientConfig(etcdRawConfig{
+		Endpoints:     "https://etcd:2379",
+		Username:      "root",
+		Password:      "secret",
+		DialTimeout:   "2s",
+		HeaderTimeout: 5,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Username != "root" || cfg.Password != "secret" {
+		t.Errorf("Expected basic auth but got %v:%v", cfg.Username, cfg.Password)
+	}
+	if cfg.HeaderTimeoutPerRequest != 5*time.Second {
+		t.Errorf("Expected header timeout 5s but got %v", cfg.HeaderTimeoutPerRequest)
+	}
+	if cfg.Transport == nil {
+		t.Errorf("Expected transport for dial timeout but got nil")
+	}
+}
+
+func TestEtcdConfigError(t *testing.T) {
+	testCases := []struct {
+		raw      map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{}, "Must provide etcd endpoints"},
+		{map[string]interface{}{"endpoints": []interface{}{}}, "Must provide etcd endpoints"},
+		{map[string]interface{}{"endpoints": "http://etcd:4001", "password": "secret"},
+			"etcd `password` requires a `username`"},
+		{map[string]interface{}{"endpoints": "http://etcd:4001", "certFile": "/etc/etcd/cert.pem"},
+			"etcd TLS configuration error: `certFile` and `keyFile` must be used together"},
+	}
+	for _, tc := range testCases {
+		if _, err := ConfigHook(tc.raw); err == nil || err.Error() != tc.expected {
+			t.Errorf("Expected %s but got %v", tc.expected, err)
+		}
+	}
+	if _, err := ConfigHook(map[string]interface{}{
+		"endpoints": "http://etcd:4001", "dialTimeout": "xx"}); err == nil {
+		t.Errorf("Expected error for bad dialTimeout but got nil")
+	}
+}
+
+func TestEtcdFilterByTags(t *testing.T) {
+	nodes := []ServiceNode{
+		{ID: "a", Tags: []string{"web", "prod"}},
+		{ID: "b", Tags: []string{"web"}, Status: discovery.StatusWarning},
+		{ID: "c"},
+	}
+	check := func(upstream *discovery.Upstream, expected ...string) {
+		var ids []string
+		for _, instance := range FilterByTags(nodes, upstream) {
+			ids = append(ids, instance.ID)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Expected %v for tags %v but got %v", expected, upstream.Tags, ids)
+		}
+	}
+	check(discovery.NewUpstream("app", ""), "a", "b", "c")
+	check(discovery.NewUpstream("app", "web"), "a", "b")
+	prod := discovery.NewUpstream("app", "web")
+	prod.Tags = append(prod.Tags, "prod")
+	check(prod, "a")
+
+	if instance := FilterByTags(nodes, prod)[0]; instance.Status != discovery.StatusPassing {
+		t.Errorf("Expected record without status to be passing but got %q", instance.Status)
+	}
+}
+
+func TestEtcdServiceNode(t *testing.T) {
+	service := &discovery.ServiceDefinition{
+		ID:        "app-1",
+		Name:      "app",
+		IPAddress: "192.168.1.1",
+		Port:      9000,
+		Tags:      []string{"web"},
+		Meta:      map[string]string{"version": "1.2"},
+		CheckName: "app",
+	}
+	node := NewServiceNode(service, discovery.StatusWarning, "slow")
+	if node.Meta["version"] != "1.2" || node.CheckName != "app" ||
+		node.Status != discovery.StatusWarning || node.Output != "slow" {
+		t.Errorf("Expected registration options in record but got %+v", node)
+	}
+	expected := discovery.ServiceInstance{
+		ID:      "app-1",
+		Address: "192.168.1.1",
+		Port:    9000,
+		Tags:    []string{"web"},
+		Meta:    map[string]string{"version": "1.2"},
+		Status:  discovery.StatusWarning,
+	}
+	if instance := node.Instance(); !reflect.DeepEqual(expected, instance) {
+		t.Errorf("Expected %+v but got %+v", expected, instance)
+	}
+}
+
 func TestEtcdTTLExpires(t *testing.T) {
 	etcd, service := setupEtcd("service-TestEtcdTTLPass")
 	id := service.ID
@@ -81,19 +180,20 @@ func TestEtcdCheckForChanges(t *testing.T) {
 	backend := "service-TestEtcdCheckForChanges"
 	etcd, service := setupEtcd(backend)
 	id := service.ID
-	if etcd.CheckForUpstreamChanges(backend, "") {
+	upstream := discovery.NewUpstream(backend, "")
+	if etcd.CheckForUpstreamChanges(upstream) {
 		t.Fatalf("First read of %s should show `false` for change", id)
 	}
 	etcd.SendHeartbeat(service) // force registration and TTL
 
-	if !etcd.CheckForUpstreamChanges(backend, "") {
+	if !etcd.CheckForUpstreamChanges(upstream) {
 		t.Errorf("%v should have changed after first health check TTL", id)
 	}
-	if etcd.CheckForUpstreamChanges(backend, "") {
+	if etcd.CheckForUpstreamChanges(upstream) {
 		t.Errorf("%v should not have changed without TTL expiring", id)
 	}
 	time.Sleep(2 * time.Second) // wait for TTL to expire
-	if !etcd.CheckForUpstreamChanges(backend, "") {
+	if !etcd.CheckForUpstreamChanges(upstream) {
 		t.Errorf("%v should have changed after TTL expired.", id)
 	}
 }
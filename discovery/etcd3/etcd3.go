@@ -0,0 +1,478 @@
+package etcd3
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/etcd"
+	"github.com/toming90/containerpilot/utils"
+	"golang.org/x/net/context"
+)
+
+func init() {
+	discovery.RegisterBackend("etcd3", ConfigHook)
+}
+
+// how long we'll wait for any single request to etcd, how long we'll
+// wait before replacing a closed watch, and how long we'll wait when
+// connecting to an etcd node unless `dialTimeout` is given
+const (
+	requestTimeout     = 5 * time.Second
+	watchRetryInterval = time.Second
+	defaultDialTimeout = 30 * time.Second
+)
+
+// Etcd3 is a service discovery backend for CoreOS etcd using the v3 API.
+// Service records use the same paths and document body (etcd.ServiceNode)
+// as the etcd backend, but expire with leases instead of TTL'd nodes.
+type Etcd3 struct {
+	Client *clientv3.Client
+	Prefix string
+
+	leases   map[string]clientv3.LeaseID
+	statuses map[string]string
+	lock     sync.Mutex
+}
+
+type etcd3RawConfig struct {
+	Endpoints   interface{} `mapstructure:"endpoints"`
+	Prefix      string      `mapstructure:"prefix"`
+	DialTimeout interface{} `mapstructure:"dialTimeout"`
+}
+
+// prefixWatch is kept in the Watch of a discovery.Upstream; its channel
+// is notified by the watch on the upstream's prefix whenever it sees a
+// change
+type prefixWatch struct {
+	changes chan struct{}
+}
+
+func parseEndpoints(endpoints interface{}) ([]string, error) {
+	switch e := endpoints.(type) {
+	case string:
+		return []string{e}, nil
+	case []string:
+		return e, nil
+	case []interface{}:
+		var result []string
+		for _, i := range e {
+			if str, ok := i.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("Must provide etcd3 endpoints")
+}
+
+// ConfigHook is the hook to register with the Etcd3 backend
+func ConfigHook(raw interface{}) (discovery.ServiceBackend, error) {
+	return NewEtcd3Config(raw)
+}
+
+// NewEtcd3Config creates a new service discovery backend for etcd v3
+func NewEtcd3Config(raw interface{}) (*Etcd3, error) {
+	etcd3 := &Etcd3{
+		Prefix:   "/containerpilot",
+		leases:   make(map[string]clientv3.LeaseID),
+		statuses: make(map[string]string),
+	}
+	var config etcd3RawConfig
+	if err := utils.DecodeRaw(raw, &config); err != nil {
+		return nil, err
+	}
+	endpoints, err := parseEndpoints(config.Endpoints)
+	if err != nil {
+		return nil, err
+	}
+	if config.Prefix != "" {
+		etcd3.Prefix = config.Prefix
+	}
+	dialTimeout := defaultDialTimeout
+	if config.DialTimeout != nil {
+		if dialTimeout, err = utils.ParseDuration(config.DialTimeout); err != nil {
+			return nil, fmt.Errorf("Could not parse etcd3 `dialTimeout`: %v", err)
+		}
+	}
+	// the client dials in the background, so the DialTimeout doesn't
+	// block until the cluster is reachable
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	etcd3.Client = client
+	return etcd3, nil
+}
+
+// GetClient returns etcd3 client
+func (c *Etcd3) GetClient() interface{} {
+	return c.Client
+}
+
+// Close implements discovery.Closer by closing the client, which stops
+// its connections and any watches still using it
+func (c *Etcd3) Close() error {
+	return c.Client.Close()
+}
+
+// Deregister removes this instance from the registry
+func (c *Etcd3) Deregister(service *discovery.ServiceDefinition) {
+	c.deregisterService(service)
+}
+
+// MarkForMaintenance removes this instance from the registry
+func (c *Etcd3) MarkForMaintenance(service *discovery.ServiceDefinition) {
+	c.deregisterService(service)
+}
+
+// SendHeartbeat refreshes the lease of this service's record
+func (c *Etcd3) SendHeartbeat(service *discovery.ServiceDefinition) {
+	c.sendTTL(service, discovery.StatusPassing, "")
+}
+
+// UpdateStatus writes a warning or critical status, along with the output
+// of the health check, to the service record. A critical service keeps
+// its record until the lease expires but is no longer returned to
+// upstream consumers.
+func (c *Etcd3) UpdateStatus(service *discovery.ServiceDefinition,
+	status, output string) {
+	if status != discovery.StatusCritical {
+		c.sendTTL(service, status, output)
+		return
+	}
+	lease, ok := c.getLease(service.ID)
+	if !ok {
+		return
+	}
+	if err := c.putService(service, lease, status, output); err != nil {
+		log.Debugf("Unable to mark %s critical: %s", service.ID, err)
+		return
+	}
+	c.setLastStatus(service.ID, status)
+}
+
+func (c *Etcd3) sendTTL(service *discovery.ServiceDefinition, status, output string) {
+	lease, err := c.keepAlive(service)
+	if err != nil {
+		log.Infof("Service not registered, registering...")
+		if lease, err = c.registerService(service); err != nil {
+			log.Warnf("Error registering service %s: %s", service.Name, err)
+			return
+		}
+	}
+	if status == discovery.StatusPassing && c.lastStatus(service.ID) == "" {
+		return
+	}
+	if err := c.putService(service, lease, status, output); err != nil {
+		log.Errorf("Failed to write status: %s", err)
+		return
+	}
+	c.setLastStatus(service.ID, status)
+}
+
+func (c *Etcd3) getNodeKey(service *discovery.ServiceDefinition) string {
+	return fmt.Sprintf("%s/%s/%s", c.Prefix, service.Name, service.ID)
+}
+
+func (c *Etcd3) getServiceKey(service *discovery.ServiceDefinition) string {
+	return fmt.Sprintf("%s/service", c.getNodeKey(service))
+}
+
+func (c *Etcd3) getAppKey(appName string) string {
+	return fmt.Sprintf("%s/%s/", c.Prefix, appName)
+}
+
+// CheckForUpstreamChanges checks another etcd node for changes. The first
+// call reads the current instances and starts a watch on the backend's
+// prefix; later calls only go back to etcd if the watch has seen events.
+func (c *Etcd3) CheckForUpstreamChanges(upstream *discovery.Upstream) bool {
+	watch := c.getWatch(upstream)
+	if !upstream.Seen() {
+		return c.refreshUpstream(upstream)
+	}
+	select {
+	case <-watch.changes:
+		return c.refreshUpstream(upstream)
+	default:
+		return false
+	}
+}
+
+// WatchForUpstreamChanges implements discovery.UpstreamWatcher by waiting
+// on the prefix watch for the backend for up to maxWait.
+func (c *Etcd3) WatchForUpstreamChanges(upstream *discovery.Upstream,
+	maxWait time.Duration) (bool, error) {
+	watch := c.getWatch(upstream)
+	if !upstream.Seen() {
+		return c.refreshUpstream(upstream), nil
+	}
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-watch.changes:
+		return c.refreshUpstream(upstream), nil
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+// getWatch returns the watch for an upstream, starting a watch on its
+// prefix if we haven't seen the upstream before. The watch is stopped
+// when the upstream is closed.
+func (c *Etcd3) getWatch(upstream *discovery.Upstream) *prefixWatch {
+	if watch, ok := upstream.Watch.(*prefixWatch); ok {
+		return watch
+	}
+	watch := &prefixWatch{changes: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.watchPrefix(ctx, c.getAppKey(upstream.Name), watch.changes)
+	upstream.Watch = watch
+	upstream.OnClose(cancel)
+	return watch
+}
+
+// watchPrefix notifies changes of any event under the prefix until the
+// context is cancelled. Watching blocks until etcd is reachable, so it
+// runs in its own goroutine, and if the watch is ever closed we start a
+// new one.
+func (c *Etcd3) watchPrefix(ctx context.Context, prefix string, changes chan struct{}) {
+	for {
+		for resp := range c.Client.Watch(ctx, prefix, clientv3.WithPrefix()) {
+			if err := resp.Err(); err != nil {
+				log.Debugf("Watch on %s failed: %s", prefix, err)
+			}
+			notify(changes)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.Client.Ctx().Done():
+			return // the client was closed
+		case <-time.After(watchRetryInterval):
+		}
+		// we may have missed events while there was no watch
+		notify(changes)
+	}
+}
+
+// notify signals a change without blocking; we re-read the whole prefix
+// after any change, so pending notifications can be coalesced
+func notify(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Etcd3) refreshUpstream(upstream *discovery.Upstream) bool {
+	services, err := c.getServices(upstream.Name)
+	if err != nil {
+		log.Warnf("Failed to query %v: %s", upstream.Name, err)
+		return false
+	}
+	return upstream.Update(etcd.FilterByTags(services, upstream))
+}
+
+func (c *Etcd3) getServices(appName string) ([]etcd.ServiceNode, error) {
+	services := []etcd.ServiceNode{}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.Client.Get(ctx, c.getAppKey(appName), clientv3.WithPrefix())
+	if err != nil {
+		return services, err
+	}
+	for _, kv := range resp.Kvs {
+		var service etcd.ServiceNode
+		if err := json.Unmarshal(kv.Value, &service); err != nil {
+			log.Warnf("Could not decode etcd3 service %s: %s", kv.Value, err)
+			continue
+		}
+		// critical instances are never upstreams, as with consul
+		if service.Status != discovery.StatusCritical {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// registerService grants a new lease for the service and writes its
+// record under that lease
+func (c *Etcd3) registerService(service *discovery.ServiceDefinition) (clientv3.LeaseID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	grant, err := c.Client.Grant(ctx, int64(service.TTL))
+	if err != nil {
+		return 0, err
+	}
+	if err := c.putService(service, grant.ID, discovery.StatusPassing, ""); err != nil {
+		return 0, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.leases[service.ID] = grant.ID
+	delete(c.statuses, service.ID)
+	return grant.ID, nil
+}
+
+// keepAlive refreshes the lease of a registered service
+func (c *Etcd3) keepAlive(service *discovery.ServiceDefinition) (clientv3.LeaseID, error) {
+	lease, ok := c.getLease(service.ID)
+	if !ok {
+		return 0, fmt.Errorf("no lease for service %s", service.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if _, err := c.Client.KeepAliveOnce(ctx, lease); err != nil {
+		return 0, err
+	}
+	return lease, nil
+}
+
+func (c *Etcd3) putService(service *discovery.ServiceDefinition,
+	lease clientv3.LeaseID, status, output string) error {
+	value, err := encodeServiceNode(service, status, output)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err = c.Client.Put(ctx, c.getServiceKey(service), value,
+		clientv3.WithLease(lease))
+	return err
+}
+
+func (c *Etcd3) deregisterService(service *discovery.ServiceDefinition) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	c.lock.Lock()
+	lease, ok := c.leases[service.ID]
+	delete(c.leases, service.ID)
+	delete(c.statuses, service.ID)
+	c.lock.Unlock()
+	if ok {
+		// revoking the lease deletes the record along with it
+		_, err := c.Client.Revoke(ctx, lease)
+		return err
+	}
+	_, err := c.Client.Delete(ctx, c.getNodeKey(service)+"/", clientv3.WithPrefix())
+	return err
+}
+
+// LookupService implements discovery.ServiceLookup. The record is
+// deleted along with its lease, so only live registrations are found.
+func (c *Etcd3) LookupService(service *discovery.ServiceDefinition) (*discovery.ServiceInstance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.Client.Get(ctx, c.getServiceKey(service))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var node etcd.ServiceNode
+	if err := json.Unmarshal(resp.Kvs[0].Value, &node); err != nil {
+		return nil, err
+	}
+	instance := node.Instance()
+	return &instance, nil
+}
+
+func (c *Etcd3) getLease(serviceID string) (clientv3.LeaseID, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lease, ok := c.leases[serviceID]
+	return lease, ok
+}
+
+func (c *Etcd3) lastStatus(serviceID string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.statuses[serviceID]
+}
+
+func (c *Etcd3) setLastStatus(serviceID, status string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if status == discovery.StatusPassing {
+		delete(c.statuses, serviceID)
+	} else {
+		c.statuses[serviceID] = status
+	}
+}
+
+func (c *Etcd3) getLockKey(lock *discovery.Lock) string {
+	return fmt.Sprintf("%s/%s/%s", c.Prefix, discovery.LockPrefix, lock.Key)
+}
+
+// TryLock implements discovery.Locker with a key attached to a lease of
+// the lock's TTL. The lease is kept alive on each call, and replaced if it
+// has expired. The key is only written if it doesn't exist, and we hold
+// the lock if the key is attached to our lease.
+func (c *Etcd3) TryLock(lock *discovery.Lock) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	lease, ok := lock.Session.(clientv3.LeaseID)
+	if ok {
+		_, err := c.Client.KeepAliveOnce(ctx, lease)
+		if err != nil && err != rpctypes.ErrLeaseNotFound {
+			return false, err
+		}
+		ok = err == nil
+	}
+	if !ok {
+		grant, err := c.Client.Grant(ctx, int64(lock.TTL))
+		if err != nil {
+			lock.Session = nil
+			return false, err
+		}
+		lease = grant.ID
+		lock.Session = lease
+	}
+	key := c.getLockKey(lock)
+	resp, err := c.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, lock.Holder, clientv3.WithLease(lease))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	return len(kvs) > 0 && clientv3.LeaseID(kvs[0].Lease) == lease, nil
+}
+
+// Unlock implements discovery.Locker by revoking the lock's lease, which
+// deletes the key along with it if we hold the lock
+func (c *Etcd3) Unlock(lock *discovery.Lock) error {
+	lease, ok := lock.Session.(clientv3.LeaseID)
+	if !ok {
+		return nil
+	}
+	lock.Session = nil
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := c.Client.Revoke(ctx, lease)
+	return err
+}
+
+func encodeServiceNode(service *discovery.ServiceDefinition, status, output string) (string, error) {
+	node := etcd.NewServiceNode(service, status, output)
+	value, err := json.Marshal(node)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
@@ -0,0 +1,179 @@
+package etcd3
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/toming90/containerpilot/discovery"
+	"golang.org/x/net/context"
+)
+
+func setupEtcd3(serviceName string) (*Etcd3, *discovery.ServiceDefinition) {
+	etcd3, _ := NewEtcd3Config(map[string]interface{}{"endpoints": []string{"http://etcd:2379"}})
+	service := &discovery.ServiceDefinition{
+		ID:        serviceName,
+		Name:      serviceName,
+		IPAddress: "192.168.1.1",
+		TTL:       2,
+		Port:      9000,
+	}
+	return etcd3, service
+}
+
+func TestEtcd3ParseEndpoints(t *testing.T) {
+	cfg, _ := NewEtcd3Config(map[string]interface{}{"endpoints": []string{"http://etcd:2379"}})
+	expected := []string{"http://etcd:2379"}
+	if actual := cfg.Client.Endpoints(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected endpoints %v but got %v", expected, actual)
+	}
+	cfg, _ = NewEtcd3Config(map[string]interface{}{"endpoints": "http://etcd:2379"})
+	if actual := cfg.Client.Endpoints(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected endpoints %v but got %v", expected, actual)
+	}
+	if cfg.Prefix != "/containerpilot" {
+		t.Errorf("Expected default prefix but got %v", cfg.Prefix)
+	}
+	if _, err := NewEtcd3Config(map[string]interface{}{}); err == nil {
+		t.Errorf("Expected error for missing endpoints but got nil")
+	}
+}
+
+func TestEtcd3DialTimeout(t *testing.T) {
+	cfg, err := NewEtcd3Config(map[string]interface{}{
+		"endpoints": "http://etcd:2379", "dialTimeout": "2s"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer cfg.Close()
+	_, err = NewEtcd3Config(map[string]interface{}{
+		"endpoints": "http://etcd:2379", "dialTimeout": "xx"})
+	if err == nil {
+		t.Errorf("Expected error for invalid dialTimeout but got nil")
+	}
+}
+
+func TestEtcd3Close(t *testing.T) {
+	etcd3, _ := setupEtcd3("service-TestEtcd3Close")
+	upstream := discovery.NewUpstream("service-TestEtcd3Close", "")
+	etcd3.getWatch(upstream)
+	if err := etcd3.Close(); err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+	select {
+	case <-etcd3.Client.Ctx().Done():
+	default:
+		t.Errorf("Expected client to be closed")
+	}
+	upstream.Close()
+}
+
+func TestEtcd3EncodeServiceNode(t *testing.T) {
+	service := &discovery.ServiceDefinition{
+		ID:        "app-1",
+		Name:      "app",
+		IPAddress: "192.168.1.1",
+		Port:      9000,
+	}
+	expected := `{"id":"app-1","name":"app","address":"192.168.1.1","port":9000,"tags":null}`
+	if value, _ := encodeServiceNode(service, discovery.StatusPassing, "ok"); value != expected {
+		t.Errorf("Expected %s but got %s", expected, value)
+	}
+	expected = `{"id":"app-1","name":"app","address":"192.168.1.1","port":9000,"tags":null,"status":"critical","output":"oops"}`
+	if value, _ := encodeServiceNode(service, discovery.StatusCritical, "oops"); value != expected {
+		t.Errorf("Expected %s but got %s", expected, value)
+	}
+}
+
+func TestEtcd3Register(t *testing.T) {
+	etcd3, service := setupEtcd3("service-TestEtcd3Register")
+	id := service.ID
+
+	// Should start off deregistered
+	if checkServiceExists(etcd3, service) {
+		t.Fatalf("Expected service %s to be deregistered, but was not", id)
+	}
+
+	// Heartbeat should register
+	etcd3.SendHeartbeat(service)
+	if !checkServiceExists(etcd3, service) {
+		t.Fatalf("Expected service %s to be registered, but was not", id)
+	}
+
+	// Explicit deregister should remove it
+	etcd3.Deregister(service)
+	if checkServiceExists(etcd3, service) {
+		t.Fatalf("Expected service %s to be deregistered, but was not", id)
+	}
+}
+
+func TestEtcd3CheckForChanges(t *testing.T) {
+	backend := "service-TestEtcd3CheckForChanges"
+	etcd3, service := setupEtcd3(backend)
+	id := service.ID
+	upstream := discovery.NewUpstream(backend, "")
+	if etcd3.CheckForUpstreamChanges(upstream) {
+		t.Fatalf("First read of %s should show `false` for change", id)
+	}
+	etcd3.SendHeartbeat(service) // force registration and lease
+	time.Sleep(100 * time.Millisecond)
+
+	if !etcd3.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after first health check TTL", id)
+	}
+	if etcd3.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should not have changed without TTL expiring", id)
+	}
+	etcd3.UpdateStatus(service, discovery.StatusCritical, "oops")
+	if changed, err := etcd3.WatchForUpstreamChanges(upstream, time.Second); !changed || err != nil {
+		t.Errorf("%v should have changed after going critical: %v", id, err)
+	}
+	time.Sleep(4 * time.Second) // wait for lease to expire
+	if checkServiceExists(etcd3, service) {
+		t.Errorf("Expected service %s to expire, but did not", id)
+	}
+}
+
+func checkServiceExists(etcd3 *Etcd3, service *discovery.ServiceDefinition) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := etcd3.Client.Get(ctx, etcd3.getServiceKey(service))
+	return err == nil && len(resp.Kvs) == 1
+}
+
+func TestEtcd3LookupService(t *testing.T) {
+	etcd3, service := setupEtcd3("service-TestEtcd3LookupService")
+	defer etcd3.Deregister(service)
+	if instance, err := etcd3.LookupService(service); err != nil || instance != nil {
+		t.Fatalf("Expected no registration but got %v (%v)", instance, err)
+	}
+	etcd3.SendHeartbeat(service)
+	instance, err := etcd3.LookupService(service)
+	if err != nil || instance == nil || instance.Address != "192.168.1.1" ||
+		instance.Port != 9000 || instance.Status != discovery.StatusPassing {
+		t.Errorf("Expected registration of %s but got %+v (%v)", service.ID, instance, err)
+	}
+}
+
+func TestEtcd3Lock(t *testing.T) {
+	etcd3, _ := setupEtcd3("service-TestEtcd3Lock")
+	ours := discovery.NewLock("service-TestEtcd3Lock/leader", "a", 2)
+	theirs := discovery.NewLock("service-TestEtcd3Lock/leader", "b", 2)
+	defer etcd3.Unlock(theirs)
+
+	if held, err := etcd3.TryLock(ours); !held || err != nil {
+		t.Fatalf("Expected to take free lock but got %v (%v)", held, err)
+	}
+	if held, err := etcd3.TryLock(theirs); held || err != nil {
+		t.Fatalf("Expected lock held by %s not to be taken (%v)", ours.Holder, err)
+	}
+	if held, err := etcd3.TryLock(ours); !held || err != nil {
+		t.Fatalf("Expected to keep our own lock (%v)", err)
+	}
+	if err := etcd3.Unlock(ours); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if held, err := etcd3.TryLock(theirs); !held || err != nil {
+		t.Errorf("Expected to take released lock (%v)", err)
+	}
+}
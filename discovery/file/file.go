@@ -0,0 +1,340 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/etcd"
+	"github.com/toming90/containerpilot/utils"
+)
+
+func init() {
+	discovery.RegisterBackend("file", ConfigHook)
+}
+
+// File is a service discovery backend that keeps registrations as JSON
+// files in a directory, which can be shared between containers with a
+// volume. It's intended for local development and tests, where running
+// Consul or etcd is inconvenient.
+type File struct {
+	Path string
+}
+
+// ServiceRecord is the serializable form of a registration. It uses the
+// same document body as the etcd backend, along with the TTL so that
+// readers can tell when the record has expired.
+type ServiceRecord struct {
+	etcd.ServiceNode
+	TTL int `json:"ttl"`
+}
+
+type fileRawConfig struct {
+	Path string `mapstructure:"path"`
+}
+
+// ConfigHook is the hook to register with the File backend
+func ConfigHook(raw interface{}) (discovery.ServiceBackend, error) {
+	return NewFileConfig(raw)
+}
+
+// NewFileConfig creates a new service discovery backend that uses the
+// directory given either as a string or as the `path` of an object
+func NewFileConfig(raw interface{}) (*File, error) {
+	var config fileRawConfig
+	switch t := raw.(type) {
+	case string:
+		config.Path = t
+	case map[string]interface{}:
+		if err := utils.DecodeRaw(t, &config); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected file config structure. Expected a string or map")
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("Must provide a `path` for file discovery")
+	}
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create file discovery directory: %v", err)
+	}
+	return &File{Path: config.Path}, nil
+}
+
+// GetClient returns the directory used by the backend
+func (c *File) GetClient() interface{} {
+	return c.Path
+}
+
+// Deregister removes this instance from the registry
+func (c *File) Deregister(service *discovery.ServiceDefinition) {
+	c.deregisterService(service)
+}
+
+// MarkForMaintenance removes this instance from the registry
+func (c *File) MarkForMaintenance(service *discovery.ServiceDefinition) {
+	c.deregisterService(service)
+}
+
+// SendHeartbeat writes the service record, which refreshes its mtime
+func (c *File) SendHeartbeat(service *discovery.ServiceDefinition) {
+	if err := c.writeService(service, discovery.StatusPassing, ""); err != nil {
+		log.Errorf("Failed to write heartbeat: %s", err)
+	}
+}
+
+// UpdateStatus writes a warning or critical status, along with the output
+// of the health check, to the service record. A critical status doesn't
+// refresh the mtime of the record, so it will still expire after the TTL.
+func (c *File) UpdateStatus(service *discovery.ServiceDefinition,
+	status, output string) {
+	if status != discovery.StatusCritical {
+		if err := c.writeService(service, status, output); err != nil {
+			log.Errorf("Failed to write status: %s", err)
+		}
+		return
+	}
+	info, err := os.Stat(c.getServiceFile(service))
+	if err != nil {
+		return // never registered, so there's nothing to mark
+	}
+	if err := c.writeService(service, status, output); err != nil {
+		log.Debugf("Unable to mark %s critical: %s", service.ID, err)
+		return
+	}
+	os.Chtimes(c.getServiceFile(service), info.ModTime(), info.ModTime())
+}
+
+func (c *File) getAppDir(appName string) string {
+	return filepath.Join(c.Path, appName)
+}
+
+func (c *File) getServiceFile(service *discovery.ServiceDefinition) string {
+	return filepath.Join(c.getAppDir(service.Name), service.ID+".json")
+}
+
+// CheckForUpstreamChanges reads the records of another service for changes
+func (c *File) CheckForUpstreamChanges(upstream *discovery.Upstream) bool {
+	services, err := c.getServices(upstream.Name)
+	if err != nil {
+		log.Warnf("Failed to query %v: %s", upstream.Name, err)
+		return false
+	}
+	return upstream.Update(etcd.FilterByTags(services, upstream))
+}
+
+// getServices returns the unexpired records of the service that aren't
+// critical
+func (c *File) getServices(appName string) ([]etcd.ServiceNode, error) {
+	services := []etcd.ServiceNode{}
+	files, err := ioutil.ReadDir(c.getAppDir(appName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return services, nil
+		}
+		return services, err
+	}
+	for _, info := range files {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(c.getAppDir(appName), info.Name())
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue // deregistered since we listed the directory
+		}
+		var record ServiceRecord
+		if err := json.Unmarshal(buf, &record); err != nil {
+			log.Warnf("Could not decode service record %s: %s", path, err)
+			continue
+		}
+		ttl := time.Duration(record.TTL) * time.Second
+		if time.Since(info.ModTime()) > ttl {
+			continue // expired
+		}
+		if record.Status == discovery.StatusCritical {
+			continue
+		}
+		services = append(services, record.ServiceNode)
+	}
+	return services, nil
+}
+
+// LookupService implements discovery.ServiceLookup. Records that have
+// expired are ignored, as they are for upstreams.
+func (c *File) LookupService(service *discovery.ServiceDefinition) (*discovery.ServiceInstance, error) {
+	path := c.getServiceFile(service)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // deregistered since we checked
+		}
+		return nil, err
+	}
+	var record ServiceRecord
+	if err := json.Unmarshal(buf, &record); err != nil {
+		return nil, err
+	}
+	if time.Since(info.ModTime()) > time.Duration(record.TTL)*time.Second {
+		return nil, nil
+	}
+	instance := record.ServiceNode.Instance()
+	return &instance, nil
+}
+
+// writeService replaces the service record. We write to a temporary file
+// and rename it so that readers never see a partial record.
+func (c *File) writeService(service *discovery.ServiceDefinition, status, output string) error {
+	record := ServiceRecord{
+		ServiceNode: etcd.NewServiceNode(service, status, output),
+		TTL:         service.TTL,
+	}
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	dir := c.getAppDir(service.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+service.ID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.getServiceFile(service))
+}
+
+func (c *File) deregisterService(service *discovery.ServiceDefinition) {
+	err := os.Remove(c.getServiceFile(service))
+	if err != nil && !os.IsNotExist(err) {
+		log.Infof("Deregistering failed: %s", err)
+	}
+}
+
+// LockRecord is the serializable form of a lock, along with its TTL so
+// that other instances can tell when the lock has expired
+type LockRecord struct {
+	Holder string `json:"holder"`
+	TTL    int    `json:"ttl"`
+}
+
+func (c *File) getLockFile(lock *discovery.Lock) string {
+	return filepath.Join(c.Path, discovery.LockPrefix, lock.Key+".json")
+}
+
+// TryLock implements discovery.Locker with a lock file. As with a service
+// record, the lock expires once the file's mtime is older than its TTL,
+// so while we hold the lock each call refreshes the mtime. Removing an
+// expired lock can race with another instance doing the same, which is
+// another reason this backend is only meant for development.
+func (c *File) TryLock(lock *discovery.Lock) (bool, error) {
+	path := c.getLockFile(lock)
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		var record LockRecord
+		buf, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(buf, &record)
+		}
+		if err != nil {
+			return false, err
+		}
+		if record.Holder == lock.Holder {
+			now := time.Now()
+			if err := os.Chtimes(path, now, now); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if time.Since(info.ModTime()) <= time.Duration(record.TTL)*time.Second {
+			return false, nil
+		}
+		os.Remove(path) // expired
+	}
+	return c.createLock(lock)
+}
+
+// createLock writes the lock to a temporary file and hard links it into
+// place, which fails if the lock file already exists, so that only one
+// instance creates the lock and readers never see a partial record
+func (c *File) createLock(lock *discovery.Lock) (bool, error) {
+	buf, err := json.Marshal(LockRecord{Holder: lock.Holder, TTL: lock.TTL})
+	if err != nil {
+		return false, err
+	}
+	path := c.getLockFile(lock)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(dir, ".lock")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Unlock implements discovery.Locker by removing the lock file, but only
+// if we're the holder written in it
+func (c *File) Unlock(lock *discovery.Lock) error {
+	path := c.getLockFile(lock)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var record LockRecord
+	if err := json.Unmarshal(buf, &record); err != nil {
+		return err
+	}
+	if record.Holder != lock.Holder {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/toming90/containerpilot/discovery"
+)
+
+func setupFile(t *testing.T, serviceName string) (*File, *discovery.ServiceDefinition) {
+	dir, _ := ioutil.TempDir("", "containerpilot")
+	file, err := NewFileConfig(map[string]interface{}{"path": dir})
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+	service := &discovery.ServiceDefinition{
+		ID:        serviceName + "-1",
+		Name:      serviceName,
+		IPAddress: "192.168.1.1",
+		TTL:       5,
+		Port:      9000,
+		Tags:      []string{"dev"},
+	}
+	return file, service
+}
+
+func TestFileConfigParse(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "containerpilot")
+	defer os.RemoveAll(dir)
+	if file, err := NewFileConfig(dir); err != nil || file.Path != dir {
+		t.Errorf("Expected path %s but got %v (%v)", dir, file, err)
+	}
+	if _, err := NewFileConfig(map[string]interface{}{}); err == nil {
+		t.Errorf("Expected error for missing path but got nil")
+	}
+	if _, err := NewFileConfig(1); err == nil {
+		t.Errorf("Expected error for bad config but got nil")
+	}
+}
+
+func TestFileRegister(t *testing.T) {
+	file, service := setupFile(t, "service-TestFileRegister")
+	defer os.RemoveAll(file.Path)
+
+	// Critical status shouldn't register the service
+	file.UpdateStatus(service, discovery.StatusCritical, "oops")
+	if checkServiceExists(file, service) {
+		t.Fatalf("Expected service %s to be deregistered, but was not", service.ID)
+	}
+
+	// Heartbeat should register
+	file.SendHeartbeat(service)
+	if !checkServiceExists(file, service) {
+		t.Fatalf("Expected service %s to be registered, but was not", service.ID)
+	}
+
+	// Explicit deregister should remove it
+	file.Deregister(service)
+	if checkServiceExists(file, service) {
+		t.Fatalf("Expected service %s to be deregistered, but was not", service.ID)
+	}
+}
+
+func TestFileCheckForChanges(t *testing.T) {
+	backend := "service-TestFileCheckForChanges"
+	file, service := setupFile(t, backend)
+	defer os.RemoveAll(file.Path)
+	id := service.ID
+	upstream := discovery.NewUpstream(backend, "")
+
+	if file.CheckForUpstreamChanges(upstream) {
+		t.Fatalf("First read of %s should show `false` for change", id)
+	}
+	file.SendHeartbeat(service)
+	if !file.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after first heartbeat", id)
+	}
+	file.SendHeartbeat(service)
+	if file.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should not have changed after another heartbeat", id)
+	}
+
+	// a critical service is no longer an upstream
+	file.UpdateStatus(service, discovery.StatusCritical, "oops")
+	if !file.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after going critical", id)
+	}
+	file.SendHeartbeat(service)
+	if !file.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after recovering", id)
+	}
+
+	// expire the record by moving its mtime past the TTL
+	past := time.Now().Add(-10 * time.Second)
+	os.Chtimes(file.getServiceFile(service), past, past)
+	if !file.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after TTL expired", id)
+	}
+}
+
+func TestFileTagFilter(t *testing.T) {
+	file, service := setupFile(t, "service-TestFileTagFilter")
+	defer os.RemoveAll(file.Path)
+	file.SendHeartbeat(service)
+
+	dev := discovery.NewUpstream(service.Name, "dev")
+	file.CheckForUpstreamChanges(dev)
+	if instances := dev.Instances(); len(instances) != 1 {
+		t.Errorf("Expected 1 service with tag dev but got %d", len(instances))
+	}
+	prod := discovery.NewUpstream(service.Name, "prod")
+	file.CheckForUpstreamChanges(prod)
+	if instances := prod.Instances(); len(instances) != 0 {
+		t.Errorf("Expected no services with tag prod but got %d", len(instances))
+	}
+}
+
+func checkServiceExists(file *File, service *discovery.ServiceDefinition) bool {
+	_, err := os.Stat(file.getServiceFile(service))
+	return err == nil
+}
+
+func TestFileLock(t *testing.T) {
+	file, _ := setupFile(t, "service-TestFileLock")
+	defer os.RemoveAll(file.Path)
+	ours := discovery.NewLock("service-TestFileLock/leader", "a", 1)
+	theirs := discovery.NewLock("service-TestFileLock/leader", "b", 1)
+
+	if held, err := file.TryLock(ours); !held || err != nil {
+		t.Fatalf("Expected to take free lock but got %v (%v)", held, err)
+	}
+	if held, err := file.TryLock(theirs); held || err != nil {
+		t.Fatalf("Expected lock held by %s not to be taken (%v)", ours.Holder, err)
+	}
+	if err := file.Unlock(theirs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if held, _ := file.TryLock(ours); !held {
+		t.Fatalf("Expected to keep our own lock")
+	}
+
+	// the lock can be taken once it expires
+	time.Sleep(1100 * time.Millisecond)
+	if held, _ := file.TryLock(theirs); !held {
+		t.Fatalf("Expected to take expired lock")
+	}
+	file.Unlock(ours)
+	if held, _ := file.TryLock(ours); held {
+		t.Fatalf("Expected Unlock not to release a lock held by %s", theirs.Holder)
+	}
+	file.Unlock(theirs)
+	if held, _ := file.TryLock(ours); !held {
+		t.Errorf("Expected to take released lock")
+	}
+}
+
+func TestFileLookupService(t *testing.T) {
+	file, service := setupFile(t, "service-TestFileLookupService")
+	defer os.RemoveAll(file.Path)
+	if instance, err := file.LookupService(service); err != nil || instance != nil {
+		t.Fatalf("Expected no registration but got %v (%v)", instance, err)
+	}
+	file.SendHeartbeat(service)
+	instance, err := file.LookupService(service)
+	if err != nil || instance == nil || instance.ID != service.ID ||
+		instance.Address != "192.168.1.1" || instance.Port != 9000 ||
+		instance.Status != discovery.StatusPassing {
+		t.Errorf("Expected registration of %s but got %+v (%v)", service.ID, instance, err)
+	}
+	past := time.Now().Add(-time.Minute)
+	os.Chtimes(file.getServiceFile(service), past, past)
+	if instance, _ := file.LookupService(service); instance != nil {
+		t.Errorf("Expected expired registration to be ignored but got %+v", instance)
+	}
+}
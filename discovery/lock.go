@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// LockPrefix is the path under which service discovery backends keep
+// their locks. Service names can only have alpha-numerics and dashes, so
+// it never collides with the path of a service.
+const LockPrefix = "_locks"
+
+// Lock is a named lock held through the service discovery backend, such
+// as the leader lock of a service. The holder must refresh the lock with
+// TryLock before its TTL expires or anyone else may take it.
+type Lock struct {
+	Key    string
+	Holder string
+	TTL    int
+
+	// Session is for the service discovery backend's own use between
+	// calls, such as the ID of a Consul session or an etcd lease
+	Session interface{}
+}
+
+// NewLock creates the state for a lock with the key, to be held by the
+// holder for TTL seconds at a time
+func NewLock(key, holder string, ttl int) *Lock {
+	return &Lock{Key: key, Holder: holder, TTL: ttl}
+}
+
+// NewLockHolder returns a holder for locks that is unique to the caller.
+// The hostname alone isn't enough, because containers can share it (as
+// with the host network), so the pid and a random suffix are added.
+func NewLockHolder() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("unable to get hostname for lock holder: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("unable to generate lock holder: %s", err)
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(buf)), nil
+}
+
+// Locker is an optional interface for service discovery backends that
+// can hold locks, which is required for leader election.
+//
+// TryLock acquires the lock if it's free, or refreshes its TTL if it's
+// already ours, returning true if we hold the lock. It never waits for
+// another holder to release it. Unlock releases the lock if we hold it.
+type Locker interface {
+	TryLock(lock *Lock) (bool, error)
+	Unlock(lock *Lock) error
+}
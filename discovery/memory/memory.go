@@ -0,0 +1,333 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/toming90/containerpilot/discovery"
+)
+
+func init() {
+	discovery.RegisterBackend("memory", ConfigHook)
+}
+
+// Methods of the backend that are recorded as a Call
+const (
+	SendHeartbeat      = "SendHeartbeat"
+	UpdateStatus       = "UpdateStatus"
+	MarkForMaintenance = "MarkForMaintenance"
+	Deregister         = "Deregister"
+	SendCheckHeartbeat = "SendCheckHeartbeat"
+	UpdateCheckStatus  = "UpdateCheckStatus"
+)
+
+// Call is a single call made to the backend. For the check methods, ID
+// is the ID of the check rather than the service.
+type Call struct {
+	Method string
+	ID     string
+	Status string
+	Output string
+}
+
+// Memory is a service discovery backend that keeps everything in memory.
+// It records every call made to it so that tests can inspect them, and
+// tests can add upstream instances with SetUpstreams, which also wakes any
+// watches of upstreams. Services that send
+// a heartbeat are also upstream instances of their own name, so a whole
+// app configured with `"memory": {}` can discover itself.
+type Memory struct {
+	calls      []Call
+	registered map[string]*discovery.ServiceDefinition
+	statuses   map[string]Call
+	upstreams  map[string][]*discovery.ServiceDefinition
+	locks      map[string]heldLock
+	changed    chan struct{}
+	lock       sync.Mutex
+}
+
+// heldLock is the holder of a lock and when it expires
+type heldLock struct {
+	holder  string
+	expires time.Time
+}
+
+// ConfigHook is the hook to register with the Memory backend. The memory
+// backend has no configuration, so the raw config is ignored.
+func ConfigHook(raw interface{}) (discovery.ServiceBackend, error) {
+	return NewMemory(), nil
+}
+
+// NewMemory creates a new, empty, in-memory service discovery backend
+func NewMemory() *Memory {
+	memory := &Memory{}
+	memory.Reset()
+	return memory
+}
+
+// Reset forgets all calls, registrations and upstream instances
+func (c *Memory) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls = []Call{}
+	c.registered = make(map[string]*discovery.ServiceDefinition)
+	c.statuses = make(map[string]Call)
+	c.upstreams = make(map[string][]*discovery.ServiceDefinition)
+	c.locks = make(map[string]heldLock)
+	c.changed = make(chan struct{})
+}
+
+// GetClient returns the backend itself
+func (c *Memory) GetClient() interface{} {
+	return c
+}
+
+// SendHeartbeat registers the service and records it as passing
+func (c *Memory) SendHeartbeat(service *discovery.ServiceDefinition) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.registered[service.ID] = service
+	c.record(Call{Method: SendHeartbeat, ID: service.ID,
+		Status: discovery.StatusPassing})
+}
+
+// UpdateStatus records the status of the service. As with the other
+// backends, a warning registers the service but a critical status does not.
+func (c *Memory) UpdateStatus(service *discovery.ServiceDefinition,
+	status, output string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if status != discovery.StatusCritical {
+		c.registered[service.ID] = service
+	}
+	c.record(Call{Method: UpdateStatus, ID: service.ID,
+		Status: status, Output: output})
+}
+
+// MarkForMaintenance removes this instance from the registry
+func (c *Memory) MarkForMaintenance(service *discovery.ServiceDefinition) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.registered, service.ID)
+	c.record(Call{Method: MarkForMaintenance, ID: service.ID})
+}
+
+// Deregister removes this instance from the registry
+func (c *Memory) Deregister(service *discovery.ServiceDefinition) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.registered, service.ID)
+	c.record(Call{Method: Deregister, ID: service.ID})
+}
+
+// SendCheckHeartbeat records one of the named checks of a service as passing
+func (c *Memory) SendCheckHeartbeat(service *discovery.ServiceDefinition,
+	check *discovery.CheckDefinition) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.record(Call{Method: SendCheckHeartbeat, ID: check.ID,
+		Status: discovery.StatusPassing})
+}
+
+// UpdateCheckStatus records the status of one of the named checks of a
+// service
+func (c *Memory) UpdateCheckStatus(service *discovery.ServiceDefinition,
+	check *discovery.CheckDefinition, status, output string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.record(Call{Method: UpdateCheckStatus, ID: check.ID,
+		Status: status, Output: output})
+}
+
+// record must be called with the lock held
+func (c *Memory) record(call Call) {
+	c.calls = append(c.calls, call)
+	if call.Status != "" {
+		c.statuses[call.ID] = call
+	}
+}
+
+// Calls returns all the calls made to the backend, in order
+func (c *Memory) Calls() []Call {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	calls := make([]Call, len(c.calls))
+	copy(calls, c.calls)
+	return calls
+}
+
+// CallCount returns the number of calls of the method for the service
+// (or check) ID
+func (c *Memory) CallCount(method, id string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	count := 0
+	for _, call := range c.calls {
+		if call.Method == method && call.ID == id {
+			count++
+		}
+	}
+	return count
+}
+
+// LastStatus returns the last status, and its output, reported for the
+// service (or check) ID. The status is empty if none has been reported.
+func (c *Memory) LastStatus(id string) (string, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	call := c.statuses[id]
+	return call.Status, call.Output
+}
+
+// IsRegistered returns true if the service ID has been registered and
+// not since deregistered or marked for maintenance
+func (c *Memory) IsRegistered(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.registered[id]
+	return ok
+}
+
+// SetUpstreams replaces the instances added by tests for the backend
+func (c *Memory) SetUpstreams(backendName string, instances ...*discovery.ServiceDefinition) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.upstreams[backendName] = instances
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// CheckForUpstreamChanges compares the instances of the backend with the
+// last check of the upstream. Like the other backends, the first check of
+// an upstream never reports a change.
+func (c *Memory) CheckForUpstreamChanges(upstream *discovery.Upstream) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	current := []discovery.ServiceInstance{}
+	for _, instance := range c.instances(upstream.Name) {
+		if upstream.HasTags(instance.Tags) {
+			current = append(current, instance)
+		}
+	}
+	return upstream.Update(current)
+}
+
+// WatchForUpstreamChanges implements discovery.UpstreamWatcher. The watch
+// returns when SetUpstreams is called, when maxWait elapses, or when the
+// upstream is closed.
+func (c *Memory) WatchForUpstreamChanges(upstream *discovery.Upstream,
+	maxWait time.Duration) (bool, error) {
+	if !upstream.Seen() {
+		return c.CheckForUpstreamChanges(upstream), nil
+	}
+	c.lock.Lock()
+	changed := c.changed
+	c.lock.Unlock()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return c.CheckForUpstreamChanges(upstream), nil
+	case <-getClosed(upstream):
+		return false, nil
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+// getClosed returns a channel that's closed when the upstream is closed
+func getClosed(upstream *discovery.Upstream) chan struct{} {
+	if closed, ok := upstream.Watch.(chan struct{}); ok {
+		return closed
+	}
+	closed := make(chan struct{})
+	upstream.Watch = closed
+	upstream.OnClose(func() { close(closed) })
+	return closed
+}
+
+// instances returns the added instances of the backend, which are always
+// passing, and the registered instances that aren't critical; it must be
+// called with the lock held
+func (c *Memory) instances(backendName string) []discovery.ServiceInstance {
+	instances := []discovery.ServiceInstance{}
+	for _, service := range c.upstreams[backendName] {
+		instances = append(instances, toInstance(service, discovery.StatusPassing))
+	}
+	ids := []string{}
+	for id := range c.registered {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		service := c.registered[id]
+		status := c.statuses[id].Status
+		if service.Name == backendName && status != discovery.StatusCritical {
+			instances = append(instances, toInstance(service, status))
+		}
+	}
+	return instances
+}
+
+// LookupService implements discovery.ServiceLookup
+func (c *Memory) LookupService(service *discovery.ServiceDefinition) (*discovery.ServiceInstance, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	registered, ok := c.registered[service.ID]
+	if !ok {
+		return nil, nil
+	}
+	instance := toInstance(registered, c.statuses[service.ID].Status)
+	return &instance, nil
+}
+
+func toInstance(service *discovery.ServiceDefinition, status string) discovery.ServiceInstance {
+	return discovery.ServiceInstance{
+		ID:      service.ID,
+		Address: service.IPAddress,
+		Port:    service.Port,
+		Tags:    service.Tags,
+		Meta:    service.Meta,
+		Status:  status,
+	}
+}
+
+// TryLock implements discovery.Locker. The lock is ours if it's free, has
+// expired, or is already held by us, in which case its TTL is refreshed.
+func (c *Memory) TryLock(lock *discovery.Lock) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	held, ok := c.locks[lock.Key]
+	if ok && held.holder != lock.Holder && now.Before(held.expires) {
+		return false, nil
+	}
+	c.locks[lock.Key] = heldLock{
+		holder:  lock.Holder,
+		expires: now.Add(time.Duration(lock.TTL) * time.Second),
+	}
+	return true, nil
+}
+
+// Unlock implements discovery.Locker
+func (c *Memory) Unlock(lock *discovery.Lock) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if held, ok := c.locks[lock.Key]; ok && held.holder == lock.Holder {
+		delete(c.locks, lock.Key)
+	}
+	return nil
+}
+
+// LockHolder returns the holder of the lock with the key, or an empty
+// string if the lock is free
+func (c *Memory) LockHolder(key string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	held, ok := c.locks[key]
+	if !ok || time.Now().After(held.expires) {
+		return ""
+	}
+	return held.holder
+}
@@ -0,0 +1,126 @@
+package memory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/toming90/containerpilot/discovery"
+)
+
+func setupMemory(serviceName string) (*Memory, *discovery.ServiceDefinition) {
+	memory := NewMemory()
+	service := &discovery.ServiceDefinition{
+		ID:        serviceName + "-1",
+		Name:      serviceName,
+		IPAddress: "192.168.1.1",
+		TTL:       1,
+		Port:      9000,
+	}
+	return memory, service
+}
+
+func TestMemoryRecordsCalls(t *testing.T) {
+	memory, service := setupMemory("service-TestMemoryRecordsCalls")
+	check := &discovery.CheckDefinition{ID: service.ID + ":db", Name: "db"}
+
+	memory.UpdateStatus(service, discovery.StatusCritical, "oops")
+	if memory.IsRegistered(service.ID) {
+		t.Fatalf("Expected critical status not to register %s", service.ID)
+	}
+	memory.SendHeartbeat(service)
+	if !memory.IsRegistered(service.ID) {
+		t.Fatalf("Expected heartbeat to register %s", service.ID)
+	}
+	memory.UpdateCheckStatus(service, check, discovery.StatusWarning, "slow")
+	memory.MarkForMaintenance(service)
+	if memory.IsRegistered(service.ID) {
+		t.Fatalf("Expected maintenance to deregister %s", service.ID)
+	}
+
+	expected := []Call{
+		{Method: UpdateStatus, ID: service.ID, Status: discovery.StatusCritical, Output: "oops"},
+		{Method: SendHeartbeat, ID: service.ID, Status: discovery.StatusPassing},
+		{Method: UpdateCheckStatus, ID: check.ID, Status: discovery.StatusWarning, Output: "slow"},
+		{Method: MarkForMaintenance, ID: service.ID},
+	}
+	if calls := memory.Calls(); !reflect.DeepEqual(expected, calls) {
+		t.Errorf("Expected calls %v but got %v", expected, calls)
+	}
+	if count := memory.CallCount(SendHeartbeat, service.ID); count != 1 {
+		t.Errorf("Expected 1 heartbeat but got %d", count)
+	}
+	if status, output := memory.LastStatus(check.ID); status != discovery.StatusWarning || output != "slow" {
+		t.Errorf("Expected warning status for check but got %q %q", status, output)
+	}
+
+	memory.Reset()
+	if len(memory.Calls()) != 0 {
+		t.Errorf("Expected no calls after reset but got %v", memory.Calls())
+	}
+}
+
+func TestMemoryCheckForChanges(t *testing.T) {
+	backend := "service-TestMemoryCheckForChanges"
+	memory, service := setupMemory(backend)
+	id := service.ID
+	upstream := discovery.NewUpstream(backend, "")
+	devUpstream := discovery.NewUpstream(backend, "dev")
+	if memory.CheckForUpstreamChanges(upstream) {
+		t.Fatalf("First read of %s should show `false` for change", id)
+	}
+	memory.SendHeartbeat(service)
+	if !memory.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after first heartbeat", id)
+	}
+	if memory.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should not have changed without a new instance", id)
+	}
+
+	memory.SetUpstreams(backend, &discovery.ServiceDefinition{
+		ID: backend + "-2", Name: backend, IPAddress: "192.168.1.2", Port: 9000,
+		Tags: []string{"dev", "blue"}})
+	if !memory.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after adding an upstream", id)
+	}
+	if memory.CheckForUpstreamChanges(devUpstream) {
+		t.Errorf("First read of %s with tag should show `false` for change", id)
+	}
+	devUpstream.Tags = append(devUpstream.Tags, "green")
+	memory.CheckForUpstreamChanges(devUpstream)
+	if instances := devUpstream.Instances(); len(instances) != 0 {
+		t.Errorf("Expected no instances with tags dev and green but got %v", instances)
+	}
+	devUpstream.Tags = []string{"dev", "blue"}
+	memory.CheckForUpstreamChanges(devUpstream)
+	memory.SetUpstreams(backend)
+	if !memory.CheckForUpstreamChanges(devUpstream) {
+		t.Errorf("%v should have changed after removing the tagged upstream", id)
+	}
+	memory.Deregister(service)
+	if !memory.CheckForUpstreamChanges(upstream) {
+		t.Errorf("%v should have changed after deregistering", id)
+	}
+}
+
+func TestMemoryLock(t *testing.T) {
+	memory := NewMemory()
+	ours := discovery.NewLock("service-TestMemoryLock/leader", "a", 5)
+	theirs := discovery.NewLock("service-TestMemoryLock/leader", "b", 5)
+	if held, err := memory.TryLock(ours); !held || err != nil {
+		t.Fatalf("Expected to take free lock but got %v (%v)", held, err)
+	}
+	if held, _ := memory.TryLock(ours); !held {
+		t.Errorf("Expected to keep our own lock")
+	}
+	if held, _ := memory.TryLock(theirs); held {
+		t.Errorf("Expected lock held by %s not to be taken", ours.Holder)
+	}
+	memory.Unlock(theirs) // not theirs to release
+	if holder := memory.LockHolder(ours.Key); holder != "a" {
+		t.Errorf("Expected lock to be held by a but got %q", holder)
+	}
+	memory.Unlock(ours)
+	if held, _ := memory.TryLock(theirs); !held {
+		t.Errorf("Expected to take released lock")
+	}
+}
@@ -0,0 +1,115 @@
+package discovery
+
+import "sync"
+
+// Upstream is the last known state of an upstream service, as seen by
+// one of the backends that depend on it. Each backend owns its Upstream,
+// so backends with the same name but different tags never share state,
+// and a reload starts over with new ones.
+type Upstream struct {
+	Name string
+	Tag  string
+
+	// Tags are all the tags an instance must have, including Tag
+	Tags []string
+
+	// Datacenter, NodeMeta and Near filter and sort instances by their
+	// node, for service discovery backends that implement NodeFilter
+	Datacenter string
+	NodeMeta   map[string]string
+	Near       string
+
+	// Index and Watch are for the service discovery backend's own use
+	// between calls, such as the index of a blocking query or a handle on
+	// a watch. They're only used by the goroutine checking the upstream.
+	Index uint64
+	Watch interface{}
+
+	instances []ServiceInstance
+	seen      bool
+	closers   []func()
+	closed    bool
+	lock      sync.Mutex
+}
+
+// NewUpstream creates the state for an upstream service and tag
+func NewUpstream(name, tag string) *Upstream {
+	upstream := &Upstream{Name: name, Tag: tag}
+	if tag != "" {
+		upstream.Tags = []string{tag}
+	}
+	return upstream
+}
+
+// HasTags returns true if the tags include all of the upstream's Tags,
+// for service discovery backends that filter instances themselves
+func (u *Upstream) HasTags(tags []string) bool {
+	for _, required := range u.Tags {
+		found := false
+		for _, tag := range tags {
+			if tag == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Instances returns the passing and warning instances seen by the last
+// check for changes
+func (u *Upstream) Instances() []ServiceInstance {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.instances
+}
+
+// Update records the instances seen by a check for changes, returning true
+// if the passing instances have changed. We don't want to cause an
+// onChange event the first time we read-in, so the first update never
+// reports a change.
+func (u *Upstream) Update(instances []ServiceInstance) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	didChange := u.seen && CompareForChange(u.instances, instances, nil)
+	u.instances = instances
+	u.seen = true
+	return didChange
+}
+
+// Seen returns true if the upstream has been checked at least once
+func (u *Upstream) Seen() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.seen
+}
+
+// OnClose registers a function to clean up after the service discovery
+// backend (ex. stopping a watch) when the upstream is closed. If the
+// upstream is already closed the function runs right away, so a watch
+// started while the backend is being stopped doesn't outlive it.
+func (u *Upstream) OnClose(fn func()) {
+	u.lock.Lock()
+	if u.closed {
+		u.lock.Unlock()
+		fn()
+		return
+	}
+	u.closers = append(u.closers, fn)
+	u.lock.Unlock()
+}
+
+// Close runs the functions registered with OnClose
+func (u *Upstream) Close() {
+	u.lock.Lock()
+	closers := u.closers
+	u.closers = nil
+	u.closed = true
+	u.lock.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+}
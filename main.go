@@ -10,6 +10,9 @@ import (
 	// Import backends so that they initialize
 	_ "github.com/toming90/containerpilot/discovery/consul"
 	_ "github.com/toming90/containerpilot/discovery/etcd"
+	_ "github.com/toming90/containerpilot/discovery/etcd3"
+	_ "github.com/toming90/containerpilot/discovery/file"
+	_ "github.com/toming90/containerpilot/discovery/memory"
 )
 
 // Main executes the containerpilot CLI
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+	dockerApi "github.com/fsouza/go-dockerclient"
+	"github.com/toming90/containerpilot/utils"
+)
+
+// cobaltWebInterface is the legacy interface name that advertises the port
+// published by the Docker daemon listening on HOST_IP:2375. It's an alias
+// for an `advertise` config.
+const cobaltWebInterface = "cobalt_web"
+
+// validHostname matches a DNS name made of dot-separated labels
+var validHostname = regexp.MustCompile(
+	`^([a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?$`)
+
+// Advertise configures how a service advertises the host address and port
+// that Docker publishes its port on, rather than the container's own
+// address, which other hosts may not be able to reach
+type Advertise struct {
+	Endpoint    string `mapstructure:"endpoint"`
+	CAFile      string `mapstructure:"caFile"`
+	CertFile    string `mapstructure:"certFile"`
+	KeyFile     string `mapstructure:"keyFile"`
+	Container   string `mapstructure:"container"`
+	Protocol    string `mapstructure:"protocol"`
+	HostAddress string `mapstructure:"hostAddress"`
+	client      *dockerApi.Client
+}
+
+func parseAdvertise(s *Service, interfaces []string) ([]string, error) {
+	if s.AdvertiseAddress != "" && net.ParseIP(s.AdvertiseAddress) == nil &&
+		!validHostname.MatchString(s.AdvertiseAddress) {
+		return nil, fmt.Errorf("`advertiseAddress` must be an IP address or hostname in service %s",
+			s.Name)
+	}
+	if s.AdvertisePort < 0 || s.AdvertisePort > 65535 {
+		return nil, fmt.Errorf("`advertisePort` must be between 1 and 65535 in service %s",
+			s.Name)
+	}
+	interfaces, cobaltWeb := withoutInterface(interfaces, cobaltWebInterface)
+	if cobaltWeb && s.Advertise == nil {
+		hostIP := os.Getenv("HOST_IP")
+		if hostIP == "" {
+			log.Warnf("HOST_IP is not set for the `%s` interface in service %s",
+				cobaltWebInterface, s.Name)
+		} else {
+			s.Advertise = &Advertise{
+				Endpoint:    fmt.Sprintf("tcp://%s:2375", hostIP),
+				HostAddress: hostIP,
+			}
+		}
+	}
+	a := s.Advertise
+	if a == nil {
+		return interfaces, nil
+	}
+	switch a.Protocol {
+	case "":
+		a.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("`protocol` in `advertise` must be tcp or udp in service %s",
+			s.Name)
+	}
+	if a.Container == "" {
+		a.Container = os.Getenv("HOSTNAME")
+	}
+	if a.Container == "" {
+		a.Container, _ = os.Hostname()
+	}
+	client, err := utils.NewDockerClient(a.Endpoint, a.CAFile, a.CertFile, a.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse `advertise` in service %s: %s", s.Name, err)
+	}
+	a.client = client
+	return interfaces, nil
+}
+
+// withoutInterface removes the interface name from the interface specs,
+// returning true if it was there
+func withoutInterface(interfaces []string, name string) ([]string, bool) {
+	var found bool
+	var remaining []string
+	for _, iface := range interfaces {
+		if iface == name {
+			found = true
+			continue
+		}
+		remaining = append(remaining, iface)
+	}
+	return remaining, found
+}
+
+// advertised returns the address and port to register for the service.
+// `advertiseAddress` and `advertisePort` override whatever we'd find
+// through `advertise` or the interfaces.
+func (s *Service) advertised() (string, int) {
+	address, port := s.IPAddress, s.Port
+	if s.Advertise != nil && (s.AdvertiseAddress == "" || s.AdvertisePort == 0) {
+		address, port = s.Advertise.resolve(s, s.IPAddress)
+	}
+	if s.AdvertiseAddress != "" {
+		address = s.AdvertiseAddress
+	}
+	if s.AdvertisePort != 0 {
+		port = s.AdvertisePort
+	}
+	return address, port
+}
+
+// resolve returns the address and port to advertise for the service. If
+// Docker doesn't tell us where the port is published, we advertise the
+// interface address and the service's own port instead.
+func (a *Advertise) resolve(s *Service, ipAddress string) (string, int) {
+	hostIP, port, err := utils.GetPublishedPort(a.client, a.Container, s.Port, a.Protocol)
+	if err != nil {
+		log.Warnf("Unable to find the published port of service %s, "+
+			"advertising %s:%d instead: %s", s.Name, ipAddress, s.Port, err)
+		return ipAddress, s.Port
+	}
+	switch {
+	case hostIP != "":
+	case a.HostAddress != "":
+		hostIP = a.HostAddress
+	default:
+		// published on all host addresses and we don't know which one
+		// is reachable, so the interface address is the best guess
+		hostIP = ipAddress
+	}
+	log.Debugf("Service %s is published on %s:%d", s.Name, hostIP, port)
+	return hostIP, port
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/utils"
+)
+
+// native health check types
+const (
+	checkTypeHTTP = "http"
+	checkTypeTCP  = "tcp"
+)
+
+// we only look for `body` in the start of the response
+const maxCheckBodySize = 64 * 1024
+
+// parseHealth parses a raw `health` config. An object configures a
+// native HTTP or TCP check; anything else is a command to run.
+func parseHealth(raw interface{}, timeoutFmt string) (*commands.Command, *nativeCheck, error) {
+	if obj, ok := raw.(map[string]interface{}); ok {
+		check, err := newNativeCheck(obj, timeoutFmt)
+		return nil, check, err
+	}
+	cmd, err := commands.NewCommand(raw, timeoutFmt)
+	return cmd, nil, err
+}
+
+// runHealth runs either the native check or the command, if any, and
+// returns the discovery status along with the output of the check. A
+// command that exits with warningExitCode (if non-zero) is a warning.
+func runHealth(cmd *commands.Command, check *nativeCheck, warningExitCode int,
+	fields log.Fields) (string, string) {
+	if check != nil {
+		if err := check.run(fields); err != nil {
+			return discovery.StatusCritical, err.Error()
+		}
+		return discovery.StatusPassing, ""
+	}
+	if cmd == nil {
+		return discovery.StatusPassing, ""
+	}
+	output, stderr, code, err := commands.RunWithTimeoutAndOutput(cmd, fields)
+	if err == nil {
+		logStderr(stderr, fields, log.DebugLevel)
+		return discovery.StatusPassing, output
+	}
+	if output == "" {
+		output = stderr
+	}
+	if output == "" {
+		output = err.Error()
+	}
+	if warningExitCode != 0 && code == warningExitCode {
+		logStderr(stderr, fields, log.WarnLevel)
+		return discovery.StatusWarning, output
+	}
+	logStderr(stderr, fields, log.ErrorLevel)
+	return discovery.StatusCritical, output
+}
+
+// logStderr logs each line of the stderr of a health check at the level,
+// which depends on whether the check passed
+func logStderr(stderr string, fields log.Fields, level log.Level) {
+	if stderr == "" {
+		return
+	}
+	entry := log.WithFields(fields)
+	for _, line := range strings.Split(stderr, "\n") {
+		switch level {
+		case log.DebugLevel:
+			entry.Debug(line)
+		case log.WarnLevel:
+			entry.Warn(line)
+		default:
+			entry.Error(line)
+		}
+	}
+}
+
+// nativeCheck is a health check that runs in-process rather than
+// forking a process, configured by giving `health` as an object
+type nativeCheck struct {
+	Type    string            `mapstructure:"type"`
+	URL     string            `mapstructure:"url"`
+	Method  string            `mapstructure:"method"`
+	Status  string            `mapstructure:"status"`
+	Body    string            `mapstructure:"body"`
+	Headers map[string]string `mapstructure:"headers"`
+	Address string            `mapstructure:"address"`
+
+	minStatus int
+	maxStatus int
+	timeout   time.Duration
+}
+
+func newNativeCheck(raw map[string]interface{}, timeoutFmt string) (*nativeCheck, error) {
+	check := &nativeCheck{}
+	if err := utils.DecodeRaw(raw, check); err != nil {
+		return nil, err
+	}
+	if timeoutFmt != "" {
+		timeout, err := utils.ParseDuration(timeoutFmt)
+		if err != nil {
+			return nil, err
+		}
+		check.timeout = timeout
+	}
+	switch check.Type {
+	case checkTypeHTTP:
+		return check, check.parseHTTP()
+	case checkTypeTCP:
+		if check.Address == "" {
+			return nil, fmt.Errorf("`address` is required for tcp checks")
+		}
+		return check, nil
+	default:
+		return nil, fmt.Errorf("`type` must be one of %q or %q, got %q",
+			checkTypeHTTP, checkTypeTCP, check.Type)
+	}
+}
+
+func (c *nativeCheck) parseHTTP() error {
+	if c.URL == "" {
+		return fmt.Errorf("`url` is required for http checks")
+	}
+	if c.Method == "" {
+		c.Method = "GET"
+	}
+	if c.Status == "" {
+		c.Status = "200-299"
+	}
+	min, max, err := parseStatusRange(c.Status)
+	if err != nil {
+		return err
+	}
+	c.minStatus = min
+	c.maxStatus = max
+	return nil
+}
+
+// parses a status code ("200") or an inclusive range of codes ("200-399")
+func parseStatusRange(status string) (int, int, error) {
+	parts := strings.SplitN(status, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid `status` %q", status)
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, fmt.Errorf("Invalid `status` %q", status)
+		}
+	}
+	if min < 100 || max > 599 || min > max {
+		return 0, 0, fmt.Errorf("Invalid `status` %q", status)
+	}
+	return min, max, nil
+}
+
+// run executes the check, returning an error if it fails
+func (c *nativeCheck) run(fields log.Fields) error {
+	var err error
+	switch c.Type {
+	case checkTypeHTTP:
+		err = c.runHTTP()
+	case checkTypeTCP:
+		err = c.runTCP()
+	}
+	if err != nil {
+		log.WithFields(fields).Infof("%s check failed: %v", c.Type, err)
+	}
+	return err
+}
+
+func (c *nativeCheck) runHTTP() error {
+	req, err := http.NewRequest(c.Method, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range c.Headers {
+		if strings.ToLower(key) == "host" {
+			req.Host = value
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
+	client := &http.Client{Timeout: c.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < c.minStatus || resp.StatusCode > c.maxStatus {
+		// drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxCheckBodySize))
+		return fmt.Errorf("%s %s returned status %d, expected %s",
+			c.Method, c.URL, resp.StatusCode, c.Status)
+	}
+	if c.Body == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBodySize))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), c.Body) {
+		return fmt.Errorf("%s %s response did not contain %q",
+			c.Method, c.URL, c.Body)
+	}
+	return nil
+}
+
+func (c *nativeCheck) runTCP() error {
+	conn, err := net.DialTimeout("tcp", c.Address, c.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+)
+
+// the stderr of a health check is logged at debug if it passes, but as an
+// error if it fails
+func TestHealthCheckStderr(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(log.InfoLevel)
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stdout)
+
+	cmd, _ := commands.NewCommand([]interface{}{"sh", "-c", "echo ok; echo noisy >&2"}, "1s")
+	status, output := runHealth(cmd, nil, 0, log.Fields{"process": "health"})
+	if status != discovery.StatusPassing || output != "ok" {
+		t.Errorf("Expected passing check with stdout but got %s %q", status, output)
+	}
+	if !strings.Contains(logs.String(), `level=debug msg=noisy`) {
+		t.Errorf("Expected stderr logged at debug but got %q", logs.String())
+	}
+
+	logs.Reset()
+	cmd, _ = commands.NewCommand([]interface{}{"sh", "-c", "echo broken >&2; exit 1"}, "1s")
+	status, output = runHealth(cmd, nil, 0, log.Fields{"process": "health"})
+	if status != discovery.StatusCritical || output != "broken" {
+		t.Errorf("Expected critical check with stderr but got %s %q", status, output)
+	}
+	if !strings.Contains(logs.String(), `level=error msg=broken`) {
+		t.Errorf("Expected stderr logged as an error but got %q", logs.String())
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Check") != "yes" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Path == "/down" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			w.Write([]byte("status: ok"))
+		}))
+	defer server.Close()
+
+	headers := map[string]interface{}{"X-Check": "yes"}
+	runNativeCheck(t, map[string]interface{}{
+		"type": "http", "url": server.URL, "headers": headers}, true)
+	runNativeCheck(t, map[string]interface{}{
+		"type": "http", "url": server.URL, "headers": headers,
+		"body": "ok"}, true)
+	runNativeCheck(t, map[string]interface{}{
+		"type": "http", "url": server.URL, "headers": headers,
+		"body": "not found"}, false)
+	runNativeCheck(t, map[string]interface{}{
+		"type": "http", "url": server.URL}, false)
+	runNativeCheck(t, map[string]interface{}{
+		"type": "http", "url": server.URL, "status": 401}, true)
+	runNativeCheck(t, map[string]interface{}{
+		"type": "http", "url": server.URL + "/down", "headers": headers}, false)
+	runNativeCheck(t, map[string]interface{}{
+		"type": "http", "url": server.URL + "/down", "headers": headers,
+		"status": "200-599"}, true)
+}
+
+func TestTCPCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	runNativeCheck(t, map[string]interface{}{"type": "tcp", "address": addr}, true)
+	ln.Close()
+	runNativeCheck(t, map[string]interface{}{"type": "tcp", "address": addr}, false)
+}
+
+func TestNativeCheckParse(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"health": {"type": "http", "url": "http://localhost/health", "status": "200-399"}, "timeout": "1s"}]`), &raw)
+	services, err := NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	check := services[0].nativeCheck
+	if check == nil || check.Method != "GET" || check.minStatus != 200 ||
+		check.maxStatus != 399 || check.timeout.Seconds() != 1 {
+		t.Errorf("Unexpected check parsed: %+v", check)
+	}
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"health": {"type": "udp"}}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `health` in service myName: `type` must be one of \"http\" or \"tcp\", got \"udp\"")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"health": {"type": "http"}}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `health` in service myName: `url` is required for http checks")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"health": {"type": "tcp"}}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `health` in service myName: `address` is required for tcp checks")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"health": {"type": "http", "url": "http://localhost", "status": "300-200"}}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `health` in service myName: Invalid `status` \"300-200\"")
+}
+
+// ------------------------------------------
+// test helpers
+
+func runNativeCheck(t *testing.T, raw map[string]interface{}, expectPass bool) {
+	check, err := newNativeCheck(raw, "1s")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing check %v: %v", raw, err)
+	}
+	service := &Service{nativeCheck: check}
+	err = service.CheckHealth()
+	if expectPass && err != nil {
+		t.Errorf("Expected check %v to pass but got %v", raw, err)
+	} else if !expectPass && err == nil {
+		t.Errorf("Expected check %v to fail but got nil error", raw)
+	}
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/utils"
+)
+
+// HealthCheck is one of several named health checks of a service. Each
+// check is polled on its own interval, and the service only sends its
+// heartbeat while all of its checks are passing.
+type HealthCheck struct {
+	ID        string
+	Name      string      `mapstructure:"name"`
+	HealthCmd interface{} `mapstructure:"health"`
+	Poll      int         `mapstructure:"poll"` // time in seconds
+	TTL       int         `mapstructure:"ttl"`
+	Timeout   string      `mapstructure:"timeout"`
+
+	service     *Service
+	cmd         *commands.Command
+	nativeCheck *nativeCheck
+	definition  *discovery.CheckDefinition
+	results     checkResults
+	lock        sync.RWMutex
+}
+
+func parseHealthChecks(s *Service) error {
+	seen := make(map[string]bool)
+	for _, check := range s.Checks {
+		if err := utils.ValidateServiceName(check.Name); err != nil {
+			return fmt.Errorf("%s in check of service %s", err, s.Name)
+		}
+		if seen[check.Name] {
+			return fmt.Errorf("duplicate check %s in service %s", check.Name, s.Name)
+		}
+		seen[check.Name] = true
+		if err := parseHealthCheck(check, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseHealthCheck(check *HealthCheck, s *Service) error {
+	if check.HealthCmd == nil {
+		return fmt.Errorf("`health` is required in check %s of service %s",
+			check.Name, s.Name)
+	}
+	if check.Poll < 1 {
+		return fmt.Errorf("`poll` must be > 0 in check %s of service %s",
+			check.Name, s.Name)
+	}
+	if check.TTL < 1 {
+		return fmt.Errorf("`ttl` must be > 0 in check %s of service %s",
+			check.Name, s.Name)
+	}
+	cmd, native, err := parseHealth(check.HealthCmd, check.Timeout)
+	if err != nil {
+		return fmt.Errorf("Could not parse `health` in check %s of service %s: %s",
+			check.Name, s.Name, err)
+	}
+	if cmd != nil {
+		cmd.Name = fmt.Sprintf("%s.%s.health", s.Name, check.Name)
+	}
+	check.cmd = cmd
+	check.nativeCheck = native
+	check.service = s
+	check.ID = fmt.Sprintf("%s:%s", s.ID, check.Name)
+	check.definition = &discovery.CheckDefinition{
+		ID:   check.ID,
+		Name: check.Name,
+		TTL:  check.TTL,
+	}
+	return nil
+}
+
+// PollTime implements Pollable for HealthCheck
+// It returns the check's poll interval.
+func (c *HealthCheck) PollTime() time.Duration {
+	return time.Duration(c.Poll) * time.Second
+}
+
+// PollAction implements Pollable for HealthCheck.
+// It runs the check and records the result, using the `rise` and `fall`
+// thresholds, `initialDelay` and `warningExitCode` of the service. If the
+// discovery service can track checks individually we also write the
+// check's status, along with its output when it isn't passing.
+func (c *HealthCheck) PollAction() {
+	if c.service.InMaintenance() || c.service.inInitialDelay() {
+		return
+	}
+	status, output := runHealth(c.cmd, c.nativeCheck, c.service.WarningExitCode,
+		log.Fields{"process": "health", "serviceName": c.service.Name,
+			"serviceID": c.service.ID, "check": c.Name})
+	switch c.recordResult(status != discovery.StatusCritical) {
+	case StatusHealthy:
+		if status == discovery.StatusCritical {
+			// still within the `fall` threshold
+			status = discovery.StatusPassing
+		}
+	default:
+		if status != discovery.StatusCritical {
+			output = risingNote
+		}
+		status = discovery.StatusCritical
+	}
+	backend, ok := c.service.discoveryService.(discovery.CheckBackend)
+	if !ok {
+		return
+	}
+	if status == discovery.StatusPassing {
+		backend.SendCheckHeartbeat(c.service.definition, c.definition)
+	} else {
+		backend.UpdateCheckStatus(c.service.definition, c.definition, status, output)
+	}
+}
+
+// PollStop does nothing in a HealthCheck
+func (c *HealthCheck) PollStop() {
+	// Nothing to do
+}
+
+// Status returns the result of the last run of the check
+func (c *HealthCheck) Status() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.results.current()
+}
+
+func (c *HealthCheck) recordResult(passed bool) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.results.record(passed, c.service.Rise, c.service.Fall)
+}
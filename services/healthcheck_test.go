@@ -0,0 +1,107 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/memory"
+)
+
+func TestHealthChecksParse(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100",
+"checks": [
+  {"name": "db", "health": "/bin/true", "poll": 5, "ttl": 10, "timeout": "1s"},
+  {"name": "web", "health": {"type": "tcp", "address": "localhost:80"}, "poll": 5, "ttl": 10}
+]}]`), &raw)
+	services, err := NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	checks := services[0].Checks
+	if len(checks) != 2 {
+		t.Fatalf("Expected 2 checks but got %d", len(checks))
+	}
+	validateCommandParsed(t, "health", checks[0].cmd, "/bin/true", nil)
+	if checks[0].ID != services[0].ID+":db" || checks[0].definition.TTL != 10 {
+		t.Errorf("Unexpected check definition: %+v", checks[0].definition)
+	}
+	if checks[1].nativeCheck == nil || checks[1].cmd != nil {
+		t.Errorf("Expected native check for %s", checks[1].Name)
+	}
+	if defs := services[0].definition.Checks; len(defs) != 2 || defs[0] != checks[0].definition {
+		t.Errorf("Expected checks to be registered with the service but got %v", defs)
+	}
+}
+
+func TestHealthChecksConfigError(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"checks": [{"name": "db", "poll": 5, "ttl": 10}]}]`), &raw)
+	_, err := NewServices(raw, nil)
+	validateServiceConfigError(t, err, "`health` is required in check db of service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"checks": [{"name": "db", "health": "/bin/true", "ttl": 10}]}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err, "`poll` must be > 0 in check db of service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"checks": [{"name": "db", "health": "/bin/true", "poll": 5}]}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err, "`ttl` must be > 0 in check db of service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"checks": [{"name": "", "health": "/bin/true", "poll": 5, "ttl": 10}]}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err, "`name` must not be blank in check of service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"checks": [{"name": "db", "health": "/bin/true", "poll": 5, "ttl": 10},
+           {"name": "db", "health": "/bin/true", "poll": 5, "ttl": 10}]}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err, "duplicate check db in service myName")
+}
+
+func TestHealthChecksAggregate(t *testing.T) {
+	backend := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100",
+"checks": [
+  {"name": "good", "health": "./testdata/test.sh doStuff", "poll": 1, "ttl": 1},
+  {"name": "bad", "health": "./testdata/test.sh failStuff", "poll": 1, "ttl": 1}
+]}]`), &raw)
+	services, err := NewServices(raw, backend)
+	validateServiceConfigError(t, err, "")
+	service := services[0]
+	good, bad := service.Checks[0], service.Checks[1]
+
+	// checks that haven't run yet block the service heartbeat
+	service.PollAction()
+	if backend.CallCount(memory.SendHeartbeat, service.ID) != 0 {
+		t.Errorf("Expected no heartbeat before checks have run")
+	}
+	good.PollAction()
+	bad.PollAction()
+	if good.Status() != StatusHealthy || bad.Status() != StatusUnhealthy {
+		t.Fatalf("Unexpected check status: good=%s bad=%s", good.Status(), bad.Status())
+	}
+	if backend.CallCount(memory.SendCheckHeartbeat, good.ID) != 1 ||
+		backend.CallCount(memory.SendCheckHeartbeat, bad.ID) != 0 {
+		t.Errorf("Expected only passing check to send heartbeat: %v", backend.Calls())
+	}
+	if status, _ := backend.LastStatus(bad.ID); status != discovery.StatusCritical {
+		t.Errorf("Expected failing check to be critical but got %q", status)
+	}
+	service.PollAction()
+	if backend.CallCount(memory.SendHeartbeat, service.ID) != 0 {
+		t.Errorf("Expected no heartbeat while a check is failing")
+	}
+	bad.cmd = good.cmd
+	bad.PollAction()
+	service.PollAction()
+	if count := backend.CallCount(memory.SendHeartbeat, service.ID); count != 1 {
+		t.Errorf("Expected heartbeat once all checks pass but got %d", count)
+	}
+}
@@ -0,0 +1,37 @@
+package services
+
+// checkResults tracks consecutive health check results, so that a status
+// only flips to healthy after `rise` passes in a row, and from healthy to
+// unhealthy after `fall` failures in a row.
+type checkResults struct {
+	status    string
+	successes int
+	failures  int
+}
+
+// record adds a check result and returns the resulting status
+func (r *checkResults) record(passed bool, rise, fall int) string {
+	if passed {
+		r.successes++
+		r.failures = 0
+		if r.successes >= rise {
+			r.status = StatusHealthy
+		}
+	} else {
+		r.failures++
+		r.successes = 0
+		// a check that has never passed has nothing to fall from
+		if r.status != StatusHealthy || r.failures >= fall {
+			r.status = StatusUnhealthy
+		}
+	}
+	return r.current()
+}
+
+// current returns the status, which is unknown until the first result
+func (r *checkResults) current() string {
+	if r.status == "" {
+		return StatusUnknown
+	}
+	return r.status
+}
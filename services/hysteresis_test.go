@@ -0,0 +1,38 @@
+package services
+
+import "testing"
+
+func TestCheckResultsRiseFall(t *testing.T) {
+	results := &checkResults{}
+	if results.current() != StatusUnknown {
+		t.Fatalf("Expected unknown status before any results")
+	}
+	expectStatus := func(passed bool, expected string) {
+		if got := results.record(passed, 2, 3); got != expected {
+			t.Fatalf("Expected %s after recording passed=%v but got %s",
+				expected, passed, got)
+		}
+	}
+	expectStatus(true, StatusUnknown)
+	expectStatus(false, StatusUnhealthy)
+	expectStatus(true, StatusUnhealthy)
+	expectStatus(true, StatusHealthy)
+	expectStatus(false, StatusHealthy)
+	expectStatus(false, StatusHealthy)
+	expectStatus(true, StatusHealthy) // resets the failure count
+	expectStatus(false, StatusHealthy)
+	expectStatus(false, StatusHealthy)
+	expectStatus(false, StatusUnhealthy)
+	expectStatus(true, StatusUnhealthy)
+	expectStatus(true, StatusHealthy)
+}
+
+func TestCheckResultsDefaults(t *testing.T) {
+	results := &checkResults{}
+	if got := results.record(true, 1, 1); got != StatusHealthy {
+		t.Errorf("Expected healthy after a single pass but got %s", got)
+	}
+	if got := results.record(false, 1, 1); got != StatusUnhealthy {
+		t.Errorf("Expected unhealthy after a single failure but got %s", got)
+	}
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/discovery"
+)
+
+// defaultIDTemplate is the ID of a service without an `id`
+const defaultIDTemplate = "{name}-{hostname}"
+
+// idField matches the fields of an `id` template. The config file is
+// already rendered as a template with `{{ }}`, so `id` uses single braces.
+var idField = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// the {random} field of an `id` is generated once per process, so that
+// the ID of a service doesn't change when the config is reloaded
+var (
+	randomSuffix     string
+	randomSuffixOnce sync.Once
+)
+
+func getRandomSuffix() string {
+	randomSuffixOnce.Do(func() {
+		buf := make([]byte, 4)
+		if _, err := rand.Read(buf); err != nil {
+			log.Warnf("Unable to generate random suffix for service IDs: %s", err)
+			buf = []byte(strconv.Itoa(os.Getpid()))
+		}
+		randomSuffix = hex.EncodeToString(buf)
+	})
+	return randomSuffix
+}
+
+// parseID renders the `id` template of the service with the address and
+// port that it advertises
+func parseID(s *Service, address string, port int) error {
+	tmpl := s.ID
+	if tmpl == "" {
+		tmpl = defaultIDTemplate
+	}
+	hostname, _ := os.Hostname()
+	fields := map[string]string{
+		"name":     s.Name,
+		"hostname": hostname,
+		"ip":       address,
+		"port":     strconv.Itoa(port),
+	}
+	var unknown string
+	id := idField.ReplaceAllStringFunc(tmpl, func(match string) string {
+		field := match[1 : len(match)-1]
+		if field == "random" {
+			return getRandomSuffix()
+		}
+		value, ok := fields[field]
+		if !ok && unknown == "" {
+			unknown = match
+		}
+		return value
+	})
+	if unknown != "" {
+		return fmt.Errorf("Could not parse `id` in service %s: unknown field %s",
+			s.Name, unknown)
+	}
+	if strings.TrimSpace(id) == "" || strings.Contains(id, "/") {
+		return fmt.Errorf("`id` must not be blank or contain `/` in service %s", s.Name)
+	}
+	s.ID = id
+	return nil
+}
+
+// CheckID returns an error if the ID of the service is already registered
+// by another instance that is still sending heartbeats, because the two
+// would keep overwriting each other's registration. A registration at our
+// own address and port is a previous run of this instance.
+func (s *Service) CheckID() error {
+	lookup, ok := s.discoveryService.(discovery.ServiceLookup)
+	if !ok {
+		return nil
+	}
+	existing, err := lookup.LookupService(s.definition)
+	if err != nil {
+		log.Warnf("Unable to check whether service ID %s is in use: %s", s.ID, err)
+		return nil
+	}
+	if existing == nil || existing.Status == discovery.StatusCritical {
+		return nil
+	}
+	if existing.Address == s.definition.IPAddress && existing.Port == s.definition.Port {
+		return nil
+	}
+	return fmt.Errorf("Service ID %s is already registered at %s:%d by another instance; "+
+		"set a unique `id` in service %s", s.ID, existing.Address, existing.Port, s.Name)
+}
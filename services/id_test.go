@@ -0,0 +1,87 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/memory"
+)
+
+func TestServiceIDTemplate(t *testing.T) {
+	hostname, _ := os.Hostname()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "web", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "checks": [
+{"name": "db", "health": "/bin/true", "poll": 1, "ttl": 1}]},
+{"name": "api", "poll": 1, "ttl": 1, "port": 8080, "interfaces": "static:192.168.1.100",
+"id": "{name}-{hostname}-{ip}-{port}-{random}"}]`), &raw)
+	services, err := NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	if expected := "web-" + hostname; services[0].ID != expected ||
+		services[0].definition.ID != expected {
+		t.Errorf("Expected default ID %s but got %s", expected, services[0].ID)
+	}
+	if services[0].Checks[0].ID != services[0].ID+":db" {
+		t.Errorf("Expected check ID from service ID but got %s", services[0].Checks[0].ID)
+	}
+	expected := regexp.MustCompile(fmt.Sprintf(
+		"^api-%s-192.168.1.100-8080-[0-9a-f]{8}$", regexp.QuoteMeta(hostname)))
+	if !expected.MatchString(services[1].ID) {
+		t.Errorf("Expected ID matching %s but got %s", expected, services[1].ID)
+	}
+
+	// the random suffix is the same when the config is reloaded
+	reloaded, _ := NewServices(raw, nil)
+	if reloaded[1].ID != services[1].ID {
+		t.Errorf("Expected ID %s after reload but got %s", services[1].ID, reloaded[1].ID)
+	}
+
+	json.Unmarshal([]byte(`[{"name": "web", "poll": 1, "ttl": 1, "port": 80,
+"id": "{name}-{pid}"}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `id` in service web: unknown field {pid}")
+
+	json.Unmarshal([]byte(`[{"name": "web", "poll": 1, "ttl": 1, "port": 80,
+"id": "{name}/{port}"}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"`id` must not be blank or contain `/` in service web")
+}
+
+func TestServiceCheckID(t *testing.T) {
+	backend := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "web", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "id": "web-1"}]`), &raw)
+	services, _ := NewServices(raw, backend)
+	service := services[0]
+	if err := service.CheckID(); err != nil {
+		t.Fatalf("Expected unregistered ID to be free but got %v", err)
+	}
+
+	// a previous run of this instance
+	backend.SendHeartbeat(service.definition)
+	if err := service.CheckID(); err != nil {
+		t.Errorf("Expected our own registration to be ignored but got %v", err)
+	}
+
+	other := &discovery.ServiceDefinition{
+		ID: "web-1", Name: "web", IPAddress: "192.168.1.100", Port: 81}
+	backend.SendHeartbeat(other)
+	expected := "Service ID web-1 is already registered at 192.168.1.100:81 " +
+		"by another instance; set a unique `id` in service web"
+	if err := service.CheckID(); err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+
+	// an instance that's no longer sending heartbeats isn't a collision
+	backend.UpdateStatus(other, discovery.StatusCritical, "")
+	if err := service.CheckID(); err != nil {
+		t.Errorf("Expected critical registration to be ignored but got %v", err)
+	}
+}
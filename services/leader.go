@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+)
+
+// Roles of an instance of a service with `leader` enabled
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+func parseLeader(s *Service) error {
+	if !s.Leader {
+		if s.OnElected != nil || s.OnDemoted != nil {
+			return fmt.Errorf("`onElected` and `onDemoted` require `leader` in service %s",
+				s.Name)
+		}
+		return nil
+	}
+	if _, ok := s.discoveryService.(discovery.Locker); !ok {
+		return fmt.Errorf("`leader` is not supported by the discovery service in service %s",
+			s.Name)
+	}
+	if s.OnElected != nil {
+		cmd, err := commands.NewCommand(s.OnElected, s.Timeout)
+		if err != nil {
+			return fmt.Errorf("Could not parse `onElected` in service %s: %s", s.Name, err)
+		}
+		cmd.Name = fmt.Sprintf("%s.onElected", s.Name)
+		s.onElectedCmd = cmd
+	}
+	if s.OnDemoted != nil {
+		cmd, err := commands.NewCommand(s.OnDemoted, s.Timeout)
+		if err != nil {
+			return fmt.Errorf("Could not parse `onDemoted` in service %s: %s", s.Name, err)
+		}
+		cmd.Name = fmt.Sprintf("%s.onDemoted", s.Name)
+		s.onDemotedCmd = cmd
+	}
+	// the service ID is often the same across instances (the default
+	// includes only the hostname), so it can't be the holder of the lock
+	holder, err := discovery.NewLockHolder()
+	if err != nil {
+		return fmt.Errorf("Could not create leader lock in service %s: %s", s.Name, err)
+	}
+	s.leaderLock = discovery.NewLock(fmt.Sprintf("%s/leader", s.Name), holder, s.TTL)
+	os.Setenv(getRoleEnvVarName(s.Name), RoleFollower)
+	return nil
+}
+
+// getRoleEnvVarName returns CONTAINERPILOT_<SERVICE>_ROLE for the service
+func getRoleEnvVarName(name string) string {
+	name = strings.Replace(strings.ToUpper(name), "-", "_", -1)
+	return fmt.Sprintf("CONTAINERPILOT_%s_ROLE", name)
+}
+
+// IsLeader returns true if this instance holds the leader lock of the
+// service
+func (s *Service) IsLeader() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.elected
+}
+
+// Role returns the role of this instance of the service, or an empty
+// string if the service doesn't have `leader` enabled
+func (s *Service) Role() string {
+	if s.leaderLock == nil {
+		return ""
+	}
+	if s.IsLeader() {
+		return RoleLeader
+	}
+	return RoleFollower
+}
+
+// campaign takes the leader lock if it's free, or keeps it if we already
+// hold it. If we can't tell whether we hold the lock, we step down rather
+// than risk having two leaders.
+func (s *Service) campaign() {
+	if s.leaderLock == nil {
+		return
+	}
+	s.electionLock.Lock()
+	defer s.electionLock.Unlock()
+	if s.InMaintenance() {
+		return // entered maintenance since this poll began
+	}
+	locker := s.discoveryService.(discovery.Locker)
+	held, err := locker.TryLock(s.leaderLock)
+	if err != nil {
+		log.Warnf("Unable to take leader lock of service %s: %s", s.Name, err)
+	}
+	s.setElected(held)
+}
+
+// resign releases the leader lock, so that another instance can take it
+// without waiting for the lock's TTL to expire. A follower has no lock to
+// release, so it's only released when the leader steps down.
+func (s *Service) resign() {
+	if s.leaderLock == nil {
+		return
+	}
+	s.electionLock.Lock()
+	defer s.electionLock.Unlock()
+	if !s.IsLeader() {
+		return
+	}
+	locker := s.discoveryService.(discovery.Locker)
+	if err := locker.Unlock(s.leaderLock); err != nil {
+		log.Warnf("Unable to release leader lock of service %s: %s", s.Name, err)
+	}
+	s.setElected(false)
+}
+
+// setElected records our role and, if it has changed, updates the
+// environment and runs the `onElected` or `onDemoted` hook. It must be
+// called with the electionLock held, so the hooks never run concurrently.
+func (s *Service) setElected(elected bool) {
+	s.lock.Lock()
+	changed := s.elected != elected
+	s.elected = elected
+	s.lock.Unlock()
+	if !changed {
+		return
+	}
+	role, cmd, hook := RoleFollower, s.onDemotedCmd, "onDemoted"
+	if elected {
+		role, cmd, hook = RoleLeader, s.onElectedCmd, "onElected"
+	}
+	log.Infof("Service %s is now the %s", s.Name, role)
+	os.Setenv(getRoleEnvVarName(s.Name), role)
+	if cmd != nil {
+		commands.RunWithTimeout(cmd, log.Fields{
+			"process": hook, "serviceName": s.Name, "serviceID": s.ID})
+	}
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/memory"
+)
+
+func TestLeaderElection(t *testing.T) {
+	hooks, _ := ioutil.TempFile("", "gotest")
+	hooks.Close()
+	defer os.Remove(hooks.Name())
+
+	backend := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "cron", "poll": 1, "ttl": 5, "port": 80,
+"interfaces": "static:192.168.1.100", "leader": true,
+"onElected": ["sh", "-c", "echo elected >> `+hooks.Name()+`"],
+"onDemoted": ["sh", "-c", "echo demoted >> `+hooks.Name()+`"]}]`), &raw)
+	first, err := NewServices(raw, backend)
+	validateServiceConfigError(t, err, "")
+	second, _ := NewServices(raw, backend)
+	// both instances have the same ID, as they would on the same host
+	a, b := first[0], second[0]
+
+	if a.Role() != RoleFollower || os.Getenv("CONTAINERPILOT_CRON_ROLE") != RoleFollower {
+		t.Fatalf("Expected to start as a follower but got %q", a.Role())
+	}
+	a.PollAction()
+	b.PollAction()
+	if !a.IsLeader() || b.IsLeader() ||
+		backend.LockHolder("cron/leader") != a.leaderLock.Holder {
+		t.Fatalf("Expected %s to be elected but lock is held by %q",
+			a.leaderLock.Holder, backend.LockHolder("cron/leader"))
+	}
+	if os.Getenv("CONTAINERPILOT_CRON_ROLE") != RoleLeader {
+		t.Errorf("Expected role in environment but got %q",
+			os.Getenv("CONTAINERPILOT_CRON_ROLE"))
+	}
+
+	// the leader gives up the lock for maintenance, so the other instance
+	// takes over on its next poll
+	a.MarkForMaintenance("")
+	b.PollAction()
+	if a.Role() != RoleFollower || b.Role() != RoleLeader {
+		t.Errorf("Expected leadership to move but got %q and %q", a.Role(), b.Role())
+	}
+	b.PollStop()
+	if backend.LockHolder("cron/leader") != "" {
+		t.Errorf("Expected lock to be released on stop")
+	}
+
+	// one line from each of a's hooks, and b's onElected, onDemoted
+	out, _ := ioutil.ReadFile(hooks.Name())
+	expected := "elected\ndemoted\nelected\ndemoted\n"
+	if string(out) != expected {
+		t.Errorf("Expected hooks to run as %q but got %q", expected, out)
+	}
+}
+
+// unlockCounter is a memory backend that counts calls to Unlock
+type unlockCounter struct {
+	*memory.Memory
+	unlocks int
+}
+
+func (c *unlockCounter) Unlock(lock *discovery.Lock) error {
+	c.unlocks++
+	return c.Memory.Unlock(lock)
+}
+
+func TestLeaderStepsDownWhenUnhealthy(t *testing.T) {
+	backend := &unlockCounter{Memory: memory.NewMemory()}
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "cron", "poll": 1, "ttl": 5, "port": 80,
+"interfaces": "static:192.168.1.100", "leader": true,
+"health": "./testdata/test.sh doStuff"}]`), &raw)
+	services, err := NewServices(raw, backend)
+	validateServiceConfigError(t, err, "")
+	service := services[0]
+
+	service.PollAction()
+	if !service.IsLeader() {
+		t.Fatalf("Expected healthy service to be elected")
+	}
+	service.healthCheckCmd.Args = []string{"failStuff"}
+	service.PollAction()
+	if service.IsLeader() || backend.LockHolder("cron/leader") != "" {
+		t.Errorf("Expected unhealthy service to step down")
+	}
+	service.PollAction()
+	if backend.unlocks != 1 {
+		t.Errorf("Expected lock to be released only when stepping down but got %d unlocks",
+			backend.unlocks)
+	}
+}
+
+func TestLeaderResignsWhenDeregistered(t *testing.T) {
+	backend := &unlockCounter{Memory: memory.NewMemory()}
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "cron", "poll": 1, "ttl": 5, "port": 80,
+"interfaces": "static:192.168.1.100", "leader": true,
+"health": "./testdata/test.sh doStuff"}]`), &raw)
+	services, err := NewServices(raw, backend)
+	validateServiceConfigError(t, err, "")
+	service := services[0]
+
+	service.PollAction()
+	service.Deregister()
+	if service.IsLeader() || backend.LockHolder("cron/leader") != "" {
+		t.Errorf("Expected deregistered service to step down")
+	}
+	service.PollStop()
+	if backend.unlocks != 1 {
+		t.Errorf("Expected lock to be released once but got %d unlocks", backend.unlocks)
+	}
+}
+
+func TestLeaderConfigError(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "onElected": "/bin/true"}]`), &raw)
+	_, err := NewServices(raw, memory.NewMemory())
+	validateServiceConfigError(t, err,
+		"`onElected` and `onDemoted` require `leader` in service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "leader": true}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"`leader` is not supported by the discovery service in service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "leader": true, "onDemoted": ""}]`), &raw)
+	_, err = NewServices(raw, memory.NewMemory())
+	if err == nil || !strings.HasPrefix(err.Error(),
+		"Could not parse `onDemoted` in service myName") {
+		t.Errorf("Expected error parsing `onDemoted` but got %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package services
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,21 +15,62 @@ import (
 
 // Service configures the service, discovery data, and health checks
 type Service struct {
-	ID               string
-	Name             string      `mapstructure:"name"`
-	Poll             int         `mapstructure:"poll"` // time in seconds
-	HealthCheckExec  interface{} `mapstructure:"health"`
-	Port             int         `mapstructure:"port"`
-	TTL              int         `mapstructure:"ttl"`
-	Interfaces       interface{} `mapstructure:"interfaces"`
-	Tags             []string    `mapstructure:"tags"`
-	Timeout          string      `mapstructure:"timeout"`
-	IPAddress        string
-	healthCheckCmd   *commands.Command
-	discoveryService discovery.ServiceBackend
-	definition       *discovery.ServiceDefinition
+	ID                             string            `mapstructure:"id"`
+	Name                           string            `mapstructure:"name"`
+	Poll                           int               `mapstructure:"poll"` // time in seconds
+	HealthCheckExec                interface{}       `mapstructure:"health"`
+	Port                           int               `mapstructure:"port"`
+	TTL                            int               `mapstructure:"ttl"`
+	Interfaces                     interface{}       `mapstructure:"interfaces"`
+	Tags                           []string          `mapstructure:"tags"`
+	Timeout                        string            `mapstructure:"timeout"`
+	Checks                         []*HealthCheck    `mapstructure:"checks"`
+	Rise                           int               `mapstructure:"rise"`
+	Fall                           int               `mapstructure:"fall"`
+	InitialDelay                   string            `mapstructure:"initialDelay"`
+	WarningExitCode                int               `mapstructure:"warningExitCode"`
+	Meta                           map[string]string `mapstructure:"meta"`
+	EnableTagOverride              bool              `mapstructure:"enableTagOverride"`
+	DeregisterCriticalServiceAfter string            `mapstructure:"deregisterCriticalServiceAfter"`
+	CheckName                      string            `mapstructure:"checkName"`
+	CheckNotes                     string            `mapstructure:"checkNotes"`
+	Leader                         bool              `mapstructure:"leader"`
+	OnElected                      interface{}       `mapstructure:"onElected"`
+	OnDemoted                      interface{}       `mapstructure:"onDemoted"`
+	Advertise                      *Advertise        `mapstructure:"advertise"`
+	AdvertiseAddress               string            `mapstructure:"advertiseAddress"`
+	AdvertisePort                  int               `mapstructure:"advertisePort"`
+	DrainTimeout                   string            `mapstructure:"drainTimeout"`
+	IPAddress                      string
+	healthCheckCmd                 *commands.Command
+	nativeCheck                    *nativeCheck
+	discoveryService               discovery.ServiceBackend
+	definition                     *discovery.ServiceDefinition
+	results                        checkResults
+	initialDelay                   time.Duration
+	startedAt                      time.Time
+	maintenance                    bool
+	maintenanceReason              string
+	drainTimeout                   time.Duration
+	drainTimer                     *time.Timer
+	drainLock                      sync.Mutex
+	markedForMaintenance           bool
+	leaderLock                     *discovery.Lock
+	elected                        bool
+	onElectedCmd                   *commands.Command
+	onDemotedCmd                   *commands.Command
+	electionLock                   sync.Mutex
+	lock                           sync.RWMutex
 }
 
+// Status values reported for a service
+const (
+	StatusUnknown     = "unknown"
+	StatusHealthy     = "healthy"
+	StatusUnhealthy   = "unhealthy"
+	StatusMaintenance = "maintenance"
+)
+
 // NewServices new services from a raw config
 func NewServices(raw []interface{}, disc discovery.ServiceBackend) ([]*Service, error) {
 	if raw == nil {
@@ -66,8 +109,6 @@ func parseService(s *Service, disc discovery.ServiceBackend) error {
 	if err := utils.ValidateServiceName(s.Name); err != nil {
 		return err
 	}
-	hostname, _ := os.Hostname()
-	s.ID = fmt.Sprintf("%s-%s", s.Name, hostname)
 	s.discoveryService = disc
 	if s.Poll < 1 {
 		return fmt.Errorf("`poll` must be > 0 in service %s", s.Name)
@@ -79,80 +120,203 @@ func parseService(s *Service, disc discovery.ServiceBackend) error {
 		return fmt.Errorf("`port` must be > 0 in service %s", s.Name)
 	}
 
+	// the ID is needed to parse the checks and leader lock, and may be
+	// made from the address and port that the service advertises
+	interfaces, ifaceErr := utils.ToStringArray(s.Interfaces)
+	if ifaceErr != nil {
+		return ifaceErr
+	}
+	interfaces, err := parseAdvertise(s, interfaces)
+	if err != nil {
+		return err
+	}
+	ipAddress, err := utils.GetIP(interfaces)
+	if err != nil {
+		return err
+	}
+	s.IPAddress = ipAddress
+	address, port := s.advertised()
+	if err := parseID(s, address, port); err != nil {
+		return err
+	}
+
 	// if the HealthCheckExec is nil then we'll have no health check
 	// command; this is useful for the telemetry service
 	if s.HealthCheckExec != nil {
-		cmd, err := commands.NewCommand(s.HealthCheckExec, s.Timeout)
+		cmd, check, err := parseHealth(s.HealthCheckExec, s.Timeout)
 		if err != nil {
 			return fmt.Errorf("Could not parse `health` in service %s: %s", s.Name, err)
 		}
-		cmd.Name = fmt.Sprintf("%s.health", s.Name)
+		if cmd != nil {
+			cmd.Name = fmt.Sprintf("%s.health", s.Name)
+		}
 		s.healthCheckCmd = cmd
+		s.nativeCheck = check
 	}
-
-	interfaces, ifaceErr := utils.ToStringArray(s.Interfaces)
-	if ifaceErr != nil {
-		return ifaceErr
+	if err := parseHysteresis(s); err != nil {
+		return err
+	}
+	if err := parseHealthChecks(s); err != nil {
+		return err
+	}
+	if err := parseLeader(s); err != nil {
+		return err
+	}
+	if err := parseRegistration(s); err != nil {
+		return err
 	}
 
-	//CUSTMIZE - get host ip and external port from env
-	// if intefaces contains 'cobalt_web'
-	for _, inteface := range interfaces {
-		if inteface == "cobalt_web" {
-			// call docker api to get inspect,
-			// from inspect we get port mappings,
-			// in this order: http, udp
-			hostIP, port, e := utils.GetInterfaceCobaltWeb(s.Port)
-			if e == nil {
-				log.Debugf("parseService[services/services.go] find external port: %v:%v", hostIP, port)
-				s.definition = &discovery.ServiceDefinition{
-					ID:        s.ID,
-					Name:      s.Name,
-					Port:      port,
-					TTL:       s.TTL,
-					Tags:      s.Tags,
-					IPAddress: hostIP,
-				}
-				return nil
-			}
+	s.definition = s.newDefinition(address, port)
+	return nil
+}
+
+// parseRegistration validates the options that are passed through to the
+// discovery service when the service is registered
+func parseRegistration(s *Service) error {
+	if s.DeregisterCriticalServiceAfter != "" {
+		after, err := utils.ParseDuration(s.DeregisterCriticalServiceAfter)
+		if err != nil {
+			return fmt.Errorf("Could not parse `deregisterCriticalServiceAfter` in service %s: %s",
+				s.Name, err)
+		}
+		if after < time.Minute {
+			return fmt.Errorf("`deregisterCriticalServiceAfter` must be at least 1m in service %s",
+				s.Name)
 		}
+		s.DeregisterCriticalServiceAfter = after.String()
 	}
-
-	ipAddress, err := utils.GetIP(interfaces)
-	if err != nil {
-		return err
+	if s.DrainTimeout != "" {
+		drain, err := utils.ParseDuration(s.DrainTimeout)
+		if err != nil {
+			return fmt.Errorf("Could not parse `drainTimeout` in service %s: %s",
+				s.Name, err)
+		}
+		s.drainTimeout = drain
 	}
-	s.IPAddress = ipAddress
+	return nil
+}
 
-	s.definition = &discovery.ServiceDefinition{
+// newDefinition creates the registration of the service at the address
+// and port
+func (s *Service) newDefinition(ipAddress string, port int) *discovery.ServiceDefinition {
+	var checks []*discovery.CheckDefinition
+	for _, check := range s.Checks {
+		checks = append(checks, check.definition)
+	}
+	return &discovery.ServiceDefinition{
 		ID:        s.ID,
 		Name:      s.Name,
-		Port:      s.Port,
+		Port:      port,
 		TTL:       s.TTL,
 		Tags:      s.Tags,
-		IPAddress: s.IPAddress,
+		IPAddress: ipAddress,
+		Meta:      s.Meta,
+
+		EnableTagOverride:              s.EnableTagOverride,
+		DeregisterCriticalServiceAfter: s.DeregisterCriticalServiceAfter,
+		CheckName:                      s.CheckName,
+		CheckNotes:                     s.CheckNotes,
+		Checks:                         checks,
+	}
+}
+
+func parseHysteresis(s *Service) error {
+	if s.Rise < 0 {
+		return fmt.Errorf("`rise` must be >= 0 in service %s", s.Name)
+	}
+	if s.Fall < 0 {
+		return fmt.Errorf("`fall` must be >= 0 in service %s", s.Name)
+	}
+	if s.WarningExitCode < 0 || s.WarningExitCode > 255 {
+		return fmt.Errorf("`warningExitCode` must be between 0 and 255 in service %s",
+			s.Name)
+	}
+	if s.Rise == 0 {
+		s.Rise = 1
+	}
+	if s.Fall == 0 {
+		s.Fall = 1
+	}
+	if s.InitialDelay != "" {
+		delay, err := utils.ParseDuration(s.InitialDelay)
+		if err != nil {
+			return fmt.Errorf("Could not parse `initialDelay` in service %s: %s",
+				s.Name, err)
+		}
+		s.initialDelay = delay
 	}
 	return nil
 }
 
 // PollTime implements Pollable for Service
 // It returns the service's poll interval.
-func (s Service) PollTime() time.Duration {
+func (s *Service) PollTime() time.Duration {
 	return time.Duration(s.Poll) * time.Second
 }
 
+// the note for a check that passed but has not yet reached `rise`
+const risingNote = "waiting for `rise` passing checks"
+
+// drainingNote is the output of the critical status that a service with
+// a `drainTimeout` reports while it drains before maintenance
+const drainingNote = "draining for maintenance"
+
 // PollAction implements Pollable for Service.
-// So long as we don't get an error back from CheckHealth, we write a TTL
-// health check to the discovery service.
+// So long as the service is healthy and all the named checks are passing,
+// we write a TTL health check to the discovery service. The service only
+// becomes healthy after `rise` passing checks in a row and unhealthy after
+// `fall` failures in a row. Once unhealthy we mark the service critical
+// right away, with the output of the check, rather than waiting for the
+// TTL to expire. Services in maintenance mode or still within their
+// `initialDelay` are not checked at all, but a service draining before
+// maintenance keeps its critical status from expiring until the drain is
+// over. With `leader` enabled, the service campaigns for the leader lock
+// while it's healthy or warning, and steps down as soon as it's critical.
 func (s *Service) PollAction() {
-	if err := s.CheckHealth(); err == nil {
+	if s.refreshDrain() || s.InMaintenance() || s.inInitialDelay() {
+		return
+	}
+	status, output := s.runHealth()
+	if s.recordResult(status != discovery.StatusCritical) != StatusHealthy {
+		if status != discovery.StatusCritical {
+			output = risingNote
+		}
+		s.UpdateStatus(discovery.StatusCritical, output)
+		s.resign()
+		return
+	}
+	if failing := s.failingChecks(); len(failing) > 0 {
+		s.UpdateStatus(discovery.StatusCritical,
+			fmt.Sprintf("failing checks: %s", strings.Join(failing, ", ")))
+		s.resign()
+		return
+	}
+	if status == discovery.StatusWarning {
+		s.UpdateStatus(status, output)
+	} else {
 		s.SendHeartbeat()
 	}
+	s.campaign()
 }
 
-// PollStop does nothing in a Service
+// SetStartTime records when the main process started, which is when
+// the service's `initialDelay` begins
+func (s *Service) SetStartTime(startedAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.startedAt = startedAt
+}
+
+func (s *Service) inInitialDelay() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return !s.startedAt.IsZero() && time.Since(s.startedAt) < s.initialDelay
+}
+
+// PollStop gives up the leader lock, if we hold it, when the service
+// stops polling
 func (s *Service) PollStop() {
-	// Nothing to do
+	s.resign()
 }
 
 // SendHeartbeat sends a heartbeat for this service
@@ -160,24 +324,210 @@ func (s *Service) SendHeartbeat() {
 	s.discoveryService.SendHeartbeat(s.definition)
 }
 
-// MarkForMaintenance marks this service for maintenance
-func (s *Service) MarkForMaintenance() {
-	s.discoveryService.MarkForMaintenance(s.definition)
+// UpdateStatus reports a warning or critical status for this service,
+// along with the output of the health check
+func (s *Service) UpdateStatus(status, output string) {
+	s.discoveryService.UpdateStatus(s.definition, status, output)
 }
 
-// Deregister will deregister this instance of the service
+// MarkForMaintenance marks this service for maintenance, giving up the
+// leader lock if we hold it. The reason is passed to discovery services
+// with their own maintenance mode. With a `drainTimeout`, the service is
+// first marked critical so that consumers stop sending it new work, and
+// only marked for maintenance in the discovery service once the drain
+// period has passed.
+func (s *Service) MarkForMaintenance(reason string) {
+	s.resign()
+	if s.drainTimeout <= 0 {
+		s.markInDiscovery(reason)
+		return
+	}
+	log.Infof("Draining service %s for %v before maintenance", s.Name, s.drainTimeout)
+	s.UpdateStatus(discovery.StatusCritical, drainingNote)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.drainTimer != nil {
+		s.drainTimer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(s.drainTimeout, func() {
+		s.drainLock.Lock()
+		defer s.drainLock.Unlock()
+		s.lock.Lock()
+		current := s.drainTimer == timer
+		if current {
+			s.drainTimer = nil
+		}
+		s.lock.Unlock()
+		if current {
+			log.Infof("Service %s drained", s.Name)
+			s.markInDiscovery(reason)
+		}
+	})
+	s.drainTimer = timer
+}
+
+// Draining checks if this service is draining before it's marked for
+// maintenance
+func (s *Service) Draining() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.drainTimer != nil
+}
+
+// refreshDrain sends the critical status of a draining service again, so
+// that it doesn't expire before the drain is over, returning false if the
+// service isn't draining. The drainLock keeps the status from being sent
+// after the service has been marked for maintenance.
+func (s *Service) refreshDrain() bool {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	if !s.Draining() {
+		return false
+	}
+	s.UpdateStatus(discovery.StatusCritical, drainingNote)
+	return true
+}
+
+// markInDiscovery uses the discovery service's own maintenance mode if it
+// has one, so the service stays visible, or else MarkForMaintenance
+func (s *Service) markInDiscovery(reason string) {
+	backend, ok := s.discoveryService.(discovery.MaintenanceBackend)
+	if !ok {
+		s.discoveryService.MarkForMaintenance(s.definition)
+		return
+	}
+	if err := backend.EnableMaintenance(s.definition, reason); err != nil {
+		log.Warnf("Unable to mark service %s for maintenance: %s", s.Name, err)
+		return
+	}
+	s.lock.Lock()
+	s.markedForMaintenance = true
+	s.lock.Unlock()
+}
+
+// cancelDrain stops a drain in progress, so the service is never marked
+// for maintenance when it leaves maintenance before the drain is over
+func (s *Service) cancelDrain() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.drainTimer != nil {
+		s.drainTimer.Stop()
+		s.drainTimer = nil
+	}
+}
+
+// ClearMaintenance cancels a drain in progress and takes the service out
+// of the discovery service's own maintenance mode, if we put it there
+func (s *Service) ClearMaintenance() {
+	s.cancelDrain()
+	s.lock.Lock()
+	marked := s.markedForMaintenance
+	s.markedForMaintenance = false
+	s.lock.Unlock()
+	if !marked {
+		return
+	}
+	backend := s.discoveryService.(discovery.MaintenanceBackend)
+	if err := backend.DisableMaintenance(s.definition); err != nil {
+		log.Warnf("Unable to take service %s out of maintenance: %s", s.Name, err)
+	}
+}
+
+// EnterMaintenance stops heartbeats for this service alone and marks
+// it for maintenance in the discovery service. It has no effect if the
+// service is already in maintenance.
+func (s *Service) EnterMaintenance(reason string) {
+	s.lock.Lock()
+	if s.maintenance {
+		s.lock.Unlock()
+		return
+	}
+	s.maintenance = true
+	s.maintenanceReason = reason
+	s.lock.Unlock()
+	s.MarkForMaintenance(reason)
+}
+
+// ExitMaintenance resumes heartbeats for this service. The service will
+// be re-registered on its next passing health check.
+func (s *Service) ExitMaintenance() {
+	s.ClearMaintenance()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maintenance = false
+	s.maintenanceReason = ""
+	s.results = checkResults{}
+}
+
+// InMaintenance checks if this service has been individually put into
+// maintenance mode
+func (s *Service) InMaintenance() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.maintenance
+}
+
+// MaintenanceReason returns the reason given when this service was put
+// into maintenance mode
+func (s *Service) MaintenanceReason() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.maintenanceReason
+}
+
+// Status returns the last known status of the service
+func (s *Service) Status() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.maintenance {
+		return StatusMaintenance
+	}
+	return s.results.current()
+}
+
+func (s *Service) recordResult(passed bool) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.results.record(passed, s.Rise, s.Fall)
+}
+
+// Deregister will deregister this instance of the service, giving up the
+// leader lock if we hold it
 func (s *Service) Deregister() {
+	s.resign()
+	s.cancelDrain()
+	s.lock.Lock()
+	s.markedForMaintenance = false // deregistering clears maintenance too
+	s.lock.Unlock()
 	s.discoveryService.Deregister(s.definition)
 }
 
-// CheckHealth runs the service's health command, returning the results
+// CheckHealth runs the service's health check, returning the results.
+// A warning from the check is not an error.
 func (s *Service) CheckHealth() error {
+	status, output := s.runHealth()
+	if status == discovery.StatusCritical {
+		return errors.New(output)
+	}
+	return nil
+}
 
+func (s *Service) runHealth() (string, string) {
 	// if we have a valid Service but there's no health check
 	// set, assume it always passes (ex. telemetry service).
-	if s.healthCheckCmd == nil {
-		return nil
+	return runHealth(s.healthCheckCmd, s.nativeCheck, s.WarningExitCode,
+		log.Fields{"process": "health", "serviceName": s.Name, "serviceID": s.ID})
+}
+
+// failingChecks returns the names of the named checks of the service
+// that did not pass on their last run
+func (s *Service) failingChecks() []string {
+	var failing []string
+	for _, check := range s.Checks {
+		if check.Status() != StatusHealthy {
+			failing = append(failing, check.Name)
+		}
 	}
-	return commands.RunWithTimeout(s.healthCheckCmd, log.Fields{
-		"process": "health", "serviceName": s.Name, "serviceID": s.ID})
+	return failing
 }
@@ -2,10 +2,16 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/toming90/containerpilot/commands"
+	"github.com/toming90/containerpilot/discovery"
+	"github.com/toming90/containerpilot/discovery/memory"
 )
 
 func TestHealthCheck(t *testing.T) {
@@ -32,6 +38,64 @@ func TestHealthCheckBad(t *testing.T) {
 	}
 }
 
+func TestHealthCheckInitialDelay(t *testing.T) {
+	backend := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "health": "./testdata/test.sh doStuff",
+"initialDelay": "1h", "rise": 2}]`), &raw)
+	services, err := NewServices(raw, backend)
+	validateServiceConfigError(t, err, "")
+	service := services[0]
+
+	service.SetStartTime(time.Now())
+	service.PollAction()
+	if service.Status() != StatusUnknown || len(backend.Calls()) != 0 {
+		t.Fatalf("Expected no check during initialDelay but got %s", service.Status())
+	}
+
+	service.SetStartTime(time.Now().Add(-2 * time.Hour))
+	service.PollAction()
+	if backend.CallCount(memory.SendHeartbeat, service.ID) != 0 {
+		t.Errorf("Expected no heartbeat before `rise` passes")
+	}
+	service.PollAction()
+	if service.Status() != StatusHealthy ||
+		backend.CallCount(memory.SendHeartbeat, service.ID) != 1 {
+		t.Errorf("Expected heartbeat after `rise` passes but got %s", service.Status())
+	}
+}
+
+func TestHealthCheckStatus(t *testing.T) {
+	backend := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "health": "./testdata/test.sh failStuff",
+"warningExitCode": 255}]`), &raw)
+	services, err := NewServices(raw, backend)
+	validateServiceConfigError(t, err, "")
+	service := services[0]
+
+	service.PollAction()
+	status, output := backend.LastStatus(service.ID)
+	if status != discovery.StatusWarning ||
+		backend.CallCount(memory.SendHeartbeat, service.ID) != 0 {
+		t.Errorf("Expected warning status but got %q", status)
+	}
+	if output != "Running failStuff with args:" {
+		t.Errorf("Expected check output in status but got %q", output)
+	}
+
+	service.WarningExitCode = 0
+	service.PollAction()
+	if status, _ = backend.LastStatus(service.ID); status != discovery.StatusCritical {
+		t.Errorf("Expected critical status but got %q", status)
+	}
+	if service.CheckHealth() == nil {
+		t.Errorf("Expected error from CheckHealth but got nil")
+	}
+}
+
 type TestFragmentServices struct {
 	Services []Service
 }
@@ -95,12 +159,221 @@ func TestServicesConfigError(t *testing.T) {
 	_, err = NewServices(raw, nil)
 	validateServiceConfigError(t, err, "")
 
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80, "rise": -1}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err, "`rise` must be >= 0 in service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80, "warningExitCode": 256}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"`warningExitCode` must be between 0 and 255 in service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80, "initialDelay": "xx"}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `initialDelay` in service myName: time: invalid duration xx")
+
 	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80, "health": "/bin/true", "timeout": "xx"}]`), &raw)
 	_, err = NewServices(raw, nil)
 	validateServiceConfigError(t, err,
 		"Could not parse `health` in service myName: time: invalid duration xx")
 }
 
+func TestServiceRegistrationOptions(t *testing.T) {
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "meta": {"version": "1.2"},
+"enableTagOverride": true, "deregisterCriticalServiceAfter": "90m",
+"checkName": "app", "checkNotes": "heartbeat of app"}]`), &raw)
+	services, err := NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	expected := &discovery.ServiceDefinition{
+		ID:        services[0].ID,
+		Name:      "myName",
+		Port:      80,
+		TTL:       1,
+		IPAddress: "192.168.1.100",
+		Meta:      map[string]string{"version": "1.2"},
+
+		EnableTagOverride:              true,
+		DeregisterCriticalServiceAfter: "1h30m0s",
+		CheckName:                      "app",
+		CheckNotes:                     "heartbeat of app",
+	}
+	if !reflect.DeepEqual(expected, services[0].definition) {
+		t.Errorf("Expected %+v but got %+v", expected, services[0].definition)
+	}
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"deregisterCriticalServiceAfter": "30s"}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"`deregisterCriticalServiceAfter` must be at least 1m in service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"deregisterCriticalServiceAfter": "xx"}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `deregisterCriticalServiceAfter` in service myName: time: invalid duration xx")
+}
+
+func TestServiceAdvertise(t *testing.T) {
+	docker := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"Id": "app", "NetworkSettings": {"Ports": {
+"80/tcp": [{"HostIp": "0.0.0.0", "HostPort": "32768"}]}}}`)
+		}))
+	defer docker.Close()
+
+	var raw []interface{}
+	json.Unmarshal([]byte(fmt.Sprintf(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100",
+"advertise": {"endpoint": "%s", "container": "app", "hostAddress": "10.0.0.5"}}]`,
+		docker.URL)), &raw)
+	services, err := NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	if def := services[0].definition; def.IPAddress != "10.0.0.5" || def.Port != 32768 {
+		t.Errorf("Expected published 10.0.0.5:32768 but got %s:%d", def.IPAddress, def.Port)
+	}
+	if services[0].IPAddress != "192.168.1.100" {
+		t.Errorf("Expected interface IP to be kept but got %s", services[0].IPAddress)
+	}
+
+	// the port isn't published over udp, so we fall back to the interface
+	json.Unmarshal([]byte(fmt.Sprintf(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100",
+"advertise": {"endpoint": "%s", "container": "app", "protocol": "udp"}}]`,
+		docker.URL)), &raw)
+	services, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	if def := services[0].definition; def.IPAddress != "192.168.1.100" || def.Port != 80 {
+		t.Errorf("Expected fallback to 192.168.1.100:80 but got %s:%d", def.IPAddress, def.Port)
+	}
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"advertise": {"protocol": "http"}}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"`protocol` in `advertise` must be tcp or udp in service myName")
+}
+
+func TestServiceAdvertiseOverrides(t *testing.T) {
+	var raw []interface{}
+	// templated values are rendered into strings, so the port may be one
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "advertiseAddress": "web-1.example.com",
+"advertisePort": "8443"}]`), &raw)
+	services, err := NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	if def := services[0].definition; def.IPAddress != "web-1.example.com" || def.Port != 8443 {
+		t.Errorf("Expected web-1.example.com:8443 but got %s:%d", def.IPAddress, def.Port)
+	}
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "advertiseAddress": "10.0.0.5"}]`), &raw)
+	services, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err, "")
+	if def := services[0].definition; def.IPAddress != "10.0.0.5" || def.Port != 80 {
+		t.Errorf("Expected 10.0.0.5:80 but got %s:%d", def.IPAddress, def.Port)
+	}
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"advertiseAddress": "not a host"}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"`advertiseAddress` must be an IP address or hostname in service myName")
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"advertisePort": 70000}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"`advertisePort` must be between 1 and 65535 in service myName")
+}
+
+func TestServiceDrainTimeout(t *testing.T) {
+	backend := memory.NewMemory()
+	var raw []interface{}
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"interfaces": "static:192.168.1.100", "drainTimeout": "50ms"}]`), &raw)
+	services, err := NewServices(raw, backend)
+	validateServiceConfigError(t, err, "")
+	service := services[0]
+
+	service.EnterMaintenance("")
+	if status, output := backend.LastStatus(service.ID); status != discovery.StatusCritical ||
+		output != drainingNote {
+		t.Errorf("Expected service to be marked critical while draining but got %s %q",
+			status, output)
+	}
+	if backend.CallCount(memory.MarkForMaintenance, service.ID) != 0 {
+		t.Fatalf("Expected no maintenance before the drain is over")
+	}
+	// polling during the drain keeps the critical status from expiring
+	service.PollAction()
+	if backend.CallCount(memory.UpdateStatus, service.ID) != 2 {
+		t.Errorf("Expected critical status to be sent again while draining: %v",
+			backend.Calls())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if backend.CallCount(memory.MarkForMaintenance, service.ID) != 1 {
+		t.Fatalf("Expected maintenance once the drain is over: %v", backend.Calls())
+	}
+	service.PollAction()
+	if backend.CallCount(memory.UpdateStatus, service.ID) != 2 {
+		t.Errorf("Expected no status once the drain is over: %v", backend.Calls())
+	}
+
+	// leaving maintenance during the drain cancels it
+	service.ExitMaintenance()
+	service.EnterMaintenance("")
+	service.ExitMaintenance()
+	time.Sleep(100 * time.Millisecond)
+	if backend.CallCount(memory.MarkForMaintenance, service.ID) != 1 {
+		t.Errorf("Expected cancelled drain not to mark for maintenance: %v", backend.Calls())
+	}
+
+	json.Unmarshal([]byte(`[{"name": "myName", "poll": 1, "ttl": 1, "port": 80,
+"drainTimeout": "xx"}]`), &raw)
+	_, err = NewServices(raw, nil)
+	validateServiceConfigError(t, err,
+		"Could not parse `drainTimeout` in service myName: time: invalid duration xx")
+}
+
+// maintenanceBackend is a memory backend with its own maintenance mode
+type maintenanceBackend struct {
+	*memory.Memory
+	reasons  []string
+	disabled int
+}
+
+func (m *maintenanceBackend) EnableMaintenance(service *discovery.ServiceDefinition,
+	reason string) error {
+	m.reasons = append(m.reasons, reason)
+	return nil
+}
+
+func (m *maintenanceBackend) DisableMaintenance(service *discovery.ServiceDefinition) error {
+	m.disabled++
+	return nil
+}
+
+func TestServiceMaintenanceBackend(t *testing.T) {
+	backend := &maintenanceBackend{Memory: memory.NewMemory()}
+	service, _ := NewService("myName", 1, 80, 1, "static:192.168.1.100", nil, backend)
+
+	service.EnterMaintenance("upgrading")
+	if !reflect.DeepEqual(backend.reasons, []string{"upgrading"}) ||
+		backend.CallCount(memory.MarkForMaintenance, service.ID) != 0 {
+		t.Fatalf("Expected native maintenance with reason but got %v %v",
+			backend.reasons, backend.Calls())
+	}
+	service.ExitMaintenance()
+	service.ExitMaintenance()
+	if backend.disabled != 1 {
+		t.Errorf("Expected maintenance to be cleared once but got %d", backend.disabled)
+	}
+}
+
 // ------------------------------------------
 // test helpers
 
@@ -15,8 +15,10 @@ type Task struct {
 	Command      interface{} `mapstructure:"command"`
 	Frequency    string      `mapstructure:"frequency"`
 	Timeout      string      `mapstructure:"timeout"`
+	Leader       string      `mapstructure:"leader"`
 	freqDuration time.Duration
 	cmd          *commands.Command
+	isLeader     func() bool
 }
 
 var taskMinDuration = 1 * time.Millisecond
@@ -79,8 +81,20 @@ func (t *Task) PollStop() {
 	t.cmd.Kill()
 }
 
-// PollAction runs the task
+// RequireLeader restricts the task to run only while isLeader returns
+// true. It's used for tasks whose `leader` names a service with leader
+// election enabled.
+func (t *Task) RequireLeader(isLeader func() bool) {
+	t.isLeader = isLeader
+}
+
+// PollAction runs the task. A task with a `leader` is skipped unless this
+// instance is the leader of that service.
 func (t *Task) PollAction() {
+	if t.Leader != "" && (t.isLeader == nil || !t.isLeader()) {
+		log.Debugf("task[%s] skipped: not the leader of %s", t.Name, t.Leader)
+		return
+	}
 	fields := log.Fields{"process": "task", "task": t.Name}
 	commands.RunWithTimeout(t.cmd, fields)
 }
@@ -171,3 +171,29 @@ func TestScheduledTaskTimeoutConfig(t *testing.T) {
 		t.Errorf("Expected %s but got %s", expected, content)
 	}
 }
+
+func TestTaskRequireLeader(t *testing.T) {
+	tmpf, _ := ioutil.TempFile("", "gotest")
+	defer func() {
+		tmpf.Close()
+		os.Remove(tmpf.Name())
+	}()
+	task := &Task{
+		Command:   []string{"testdata/test.sh", "echoOut", ".", tmpf.Name()},
+		Frequency: "100ms",
+		Leader:    "cron",
+	}
+	expectNoParseError(t, task)
+
+	// a task with a `leader` never runs until it knows who the leader is
+	task.PollAction()
+	leader := false
+	task.RequireLeader(func() bool { return leader })
+	task.PollAction()
+	leader = true
+	task.PollAction()
+	content, _ := ioutil.ReadAll(tmpf)
+	if string(content) != "." {
+		t.Errorf("Expected task to run only as leader but got %q", content)
+	}
+}
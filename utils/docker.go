@@ -1,64 +1,103 @@
 package utils
 
 import (
-	"errors"
 	"fmt"
-	"os"
+	"net/http"
 	"strconv"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	dockerApi "github.com/fsouza/go-dockerclient"
 )
 
-func GetInterfaceCobaltWeb(intPort int) (string, int, error) {
-	log.Info("GetInterfaceCobaltWeb starting...")
-	containerID := os.Getenv("HOSTNAME")
+// DefaultDockerEndpoint is the Docker API endpoint used if none is given
+const DefaultDockerEndpoint = "unix:///var/run/docker.sock"
 
-	hostIP := os.Getenv("HOST_IP")
+// dockerTimeout bounds each request to the Docker API, so that an
+// unreachable daemon can't hold up loading the config
+const dockerTimeout = 10 * time.Second
 
-	if containerID == "" || hostIP == "" {
-		log.Error("Error: environment variable HOSTNAME or HOST_IPq is not set.")
-		return "", -1, errors.New("Error: environment variable HOSTNAME or NOMAD_ADDR_cobalt is not set.")
+// NewDockerClient creates a client for the Docker API at the endpoint,
+// which is either a unix socket or a TCP address. TLS is used if any of
+// the CA, cert or key files are given; the cert and key files must be
+// given together.
+func NewDockerClient(endpoint, caFile, certFile, keyFile string) (*dockerApi.Client, error) {
+	if endpoint == "" {
+		endpoint = DefaultDockerEndpoint
 	}
-	port, e := GetAppExternalPort(hostIP, containerID, strconv.Itoa(intPort))
-	if e != nil {
-		msg := fmt.Sprintf("GetAppExternalPort encounter error: %v", e)
-		return "", -1, errors.New(msg)
-
+	if caFile == "" && certFile == "" && keyFile == "" {
+		client, err := dockerApi.NewClient(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient.Timeout = dockerTimeout
+		return client, nil
 	}
-	return hostIP, port, nil
-}
-
-// GetAppExternalPort get actual external port
-func GetAppExternalPort(hostIP string, containerID string, appInternalPort string) (int, error) {
-	log.Info("GetAppExternalPort starting...")
-
-	client, err := dockerApi.NewClient("tcp://" + hostIP + ":2375")
+	tlsConfig, err := NewTLSConfig(caFile, certFile, keyFile)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
+	// the client's own TLS setup skips verification of the daemon without
+	// a CA file, so we only use it to parse the endpoint and then swap in
+	// our config, which falls back to the system roots instead
+	client, err := dockerApi.NewTLSClientFromBytes(endpoint, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	client.TLSConfig = tlsConfig
+	client.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		Timeout: dockerTimeout,
+	}
+	return client, nil
+}
+
+// GetPublishedPort asks Docker for the host address and port that the
+// container's port is published on. The address is empty if the port is
+// published on all of the host's addresses.
+func GetPublishedPort(client *dockerApi.Client, containerID string,
+	port int, protocol string) (string, int, error) {
 	container, err := client.InspectContainer(containerID)
 	if err != nil {
-		return -1, err
+		return "", 0, err
+	}
+	if container.NetworkSettings == nil {
+		return "", 0, fmt.Errorf("container %s has no network settings", containerID)
 	}
+	return findPublishedPort(container.NetworkSettings.Ports, port, protocol)
+}
 
-	portMaps := container.NetworkSettings.Ports
-	protocolOrders := []string{"http", "udp"}
-	for _, protocol := range protocolOrders {
-		portNameStr := (appInternalPort + "/" + protocol)
-		portName := dockerApi.Port(portNameStr)
-		if list, ok := portMaps[portName]; ok {
-			for _, ipAndPort := range list {
-				if hostIP == ipAndPort.HostIP {
-					port, e := strconv.Atoi(ipAndPort.HostPort)
-					if e != nil {
-						log.Errorf("GetAppExternalPort[services/docker] cannot convert port %v to int. %v", ipAndPort.HostPort, e.Error())
-						continue
-					}
-					return port, nil
-				}
-			}
+// findPublishedPort picks the binding of the port from the container's
+// port bindings. A binding to a specific host address is preferred over
+// one to all addresses, because it's the address other hosts can reach.
+func findPublishedPort(ports map[dockerApi.Port][]dockerApi.PortBinding,
+	port int, protocol string) (string, int, error) {
+	name := dockerApi.Port(fmt.Sprintf("%d/%s", port, protocol))
+	bindings := ports[name]
+	if len(bindings) == 0 {
+		return "", 0, fmt.Errorf("port %s is not published", name)
+	}
+	binding := bindings[0]
+	for _, b := range bindings {
+		if !isUnspecifiedAddress(b.HostIP) {
+			binding = b
+			break
 		}
 	}
-	return -1, errors.New("GetAppExternalPort[services/docker] Error: cannot find suitable port.")
+	hostPort, err := strconv.Atoi(binding.HostPort)
+	if err != nil || hostPort < 1 {
+		return "", 0, fmt.Errorf("port %s is published on invalid host port %q",
+			name, binding.HostPort)
+	}
+	hostIP := binding.HostIP
+	if isUnspecifiedAddress(hostIP) {
+		hostIP = ""
+	}
+	return hostIP, hostPort, nil
+}
+
+func isUnspecifiedAddress(ip string) bool {
+	return ip == "" || ip == "0.0.0.0" || ip == "::"
 }
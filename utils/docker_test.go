@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dockerApi "github.com/fsouza/go-dockerclient"
+)
+
+func TestFindPublishedPort(t *testing.T) {
+	ports := map[dockerApi.Port][]dockerApi.PortBinding{
+		"8080/tcp": {{HostIP: "0.0.0.0", HostPort: "32768"}},
+		"9090/tcp": {
+			{HostIP: "::", HostPort: "32770"},
+			{HostIP: "10.0.0.5", HostPort: "32771"},
+		},
+		"9090/udp": {{HostIP: "", HostPort: "32772"}},
+		"7070/tcp": {{HostIP: "10.0.0.5", HostPort: ""}},
+	}
+	runFindPublishedPortTest(t, ports, 8080, "tcp", "", 32768, "")
+	runFindPublishedPortTest(t, ports, 9090, "tcp", "10.0.0.5", 32771, "")
+	runFindPublishedPortTest(t, ports, 9090, "udp", "", 32772, "")
+	runFindPublishedPortTest(t, ports, 8080, "udp", "", 0,
+		"port 8080/udp is not published")
+	runFindPublishedPortTest(t, ports, 7070, "tcp", "", 0,
+		`port 7070/tcp is published on invalid host port ""`)
+}
+
+func runFindPublishedPortTest(t *testing.T, ports map[dockerApi.Port][]dockerApi.PortBinding,
+	port int, protocol, expectedIP string, expectedPort int, expectedErr string) {
+	ip, hostPort, err := findPublishedPort(ports, port, protocol)
+	if expectedErr != "" {
+		if err == nil || err.Error() != expectedErr {
+			t.Errorf("Expected %s but got %v", expectedErr, err)
+		}
+		return
+	}
+	if err != nil || ip != expectedIP || hostPort != expectedPort {
+		t.Errorf("Expected %s:%d for %d/%s but got %s:%d (%v)",
+			expectedIP, expectedPort, port, protocol, ip, hostPort, err)
+	}
+}
+
+func TestGetPublishedPort(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/containers/app/json" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"Id": "app", "NetworkSettings": {"Ports": {
+"8080/tcp": [{"HostIp": "10.0.0.5", "HostPort": "32768"}]}}}`)
+		}))
+	defer server.Close()
+
+	client, err := NewDockerClient(server.URL, "", "", "")
+	if err != nil {
+		t.Fatalf("Unable to create Docker client: %v", err)
+	}
+	ip, port, err := GetPublishedPort(client, "app", 8080, "tcp")
+	if err != nil || ip != "10.0.0.5" || port != 32768 {
+		t.Errorf("Expected 10.0.0.5:32768 but got %s:%d (%v)", ip, port, err)
+	}
+	if _, _, err = GetPublishedPort(client, "missing", 8080, "tcp"); err == nil {
+		t.Errorf("Expected error for missing container but got nil")
+	}
+}
+
+func TestNewDockerClientTLS(t *testing.T) {
+	if _, err := NewDockerClient("tcp://docker:2376", "", "cert.pem", ""); err == nil {
+		t.Errorf("Expected error for `certFile` without `keyFile` but got nil")
+	}
+	if _, err := NewDockerClient("tcp://docker:2376", "/does/not/exist", "", ""); err == nil {
+		t.Errorf("Expected error for missing `caFile` but got nil")
+	}
+	if _, err := NewDockerClient("ftp://docker", "", "", ""); err == nil {
+		t.Errorf("Expected error for invalid endpoint but got nil")
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writes a self-signed cert and its key to dir, returning their paths
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	config, err := NewTLSConfig(certFile, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 1 {
+		t.Errorf("Expected CA and client certificate but got %+v", config)
+	}
+
+	if _, err := NewTLSConfig("", certFile, ""); err == nil {
+		t.Errorf("Expected error for cert without key but got nil")
+	}
+	if _, err := NewTLSConfig(filepath.Join(dir, "missing.pem"), "", ""); err == nil {
+		t.Errorf("Expected error for missing CA file but got nil")
+	}
+	if _, err := NewTLSConfig(keyFile, "", ""); err == nil {
+		t.Errorf("Expected error for CA file without certificates but got nil")
+	}
+}